@@ -0,0 +1,343 @@
+package multipath
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imgk/shadow/common"
+)
+
+// DefaultWindowSize bounds the dedup bitmap's sliding window.
+const DefaultWindowSize = 4096
+
+// DefaultReorderDelay bounds how long a datagram is held for an
+// out-of-order predecessor before being delivered anyway.
+const DefaultReorderDelay = time.Millisecond * 20
+
+// Config configures a PacketConn.
+type Config struct {
+	// K is how many of the N underlying paths each datagram is sent on.
+	// 1 <= K <= len(paths).
+	K int
+	// FECGroup is how many data packets share one XOR parity packet. 0 or
+	// 1 disables FEC.
+	FECGroup int
+	// ReorderDelay bounds how long an out-of-order datagram is held for
+	// its predecessor. Defaults to DefaultReorderDelay.
+	ReorderDelay time.Duration
+	// WindowSize bounds the dedup sliding window. Defaults to
+	// DefaultWindowSize.
+	WindowSize uint32
+}
+
+type pathStats struct {
+	sent    uint64
+	recv    uint64
+	dropped uint64
+}
+
+// PacketConn is a common.PacketConn that transmits every datagram over K of
+// N underlying paths and deduplicates/recombines on receive, so a single
+// lost datagram on a flaky path doesn't stall the flow.
+type PacketConn struct {
+	paths []common.PacketConn
+	k     int
+
+	seq uint32 // next sequence number to send, atomically incremented
+
+	fecGroup int
+	fecEnc   *fecEncoder
+	fecMu    sync.Mutex
+	fecRecv  map[uint32]*fecGroupState
+
+	window   *dedupWindow
+	windowMu sync.Mutex
+
+	reorder *reorderBuffer
+
+	stats   []pathStats
+	statsMu sync.Mutex
+
+	localAddr   net.Addr
+	localAddrMu sync.Mutex
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+	wg        sync.WaitGroup
+}
+
+type fecGroupState struct {
+	data   [][]byte
+	parity []byte
+	count  int
+}
+
+// NewPacketConn wraps paths into a single redundant common.PacketConn,
+// transparently spreading writes across them and deduplicating reads. A
+// caller that holds more than one common.PacketConn for the same flow (e.g.
+// several egress handlers registered for one target) can hand them all to
+// NewPacketConn instead of picking just one.
+func NewPacketConn(paths []common.PacketConn, cfg Config) (*PacketConn, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("multipath: no paths given")
+	}
+	if cfg.K <= 0 {
+		cfg.K = 1
+	}
+	if cfg.K > len(paths) {
+		cfg.K = len(paths)
+	}
+	if cfg.ReorderDelay <= 0 {
+		cfg.ReorderDelay = DefaultReorderDelay
+	}
+	if cfg.WindowSize == 0 {
+		cfg.WindowSize = DefaultWindowSize
+	}
+
+	pc := &PacketConn{
+		paths:    paths,
+		k:        cfg.K,
+		fecGroup: cfg.FECGroup,
+		fecRecv:  make(map[uint32]*fecGroupState),
+		window:   newDedupWindow(cfg.WindowSize),
+		reorder:  newReorderBuffer(cfg.ReorderDelay, 256),
+		stats:    make([]pathStats, len(paths)),
+		closeCh:  make(chan struct{}),
+	}
+	if cfg.FECGroup > 1 {
+		pc.fecEnc = newFECEncoder(cfg.FECGroup)
+	}
+
+	for i, p := range paths {
+		pc.wg.Add(1)
+		go pc.readLoop(i, p)
+	}
+
+	return pc, nil
+}
+
+// ReadTo implements common.PacketConn, delivering payloads in sequence
+// order (within the configured reorder delay) after dedup.
+func (pc *PacketConn) ReadTo(b []byte) (int, net.Addr, error) {
+	select {
+	case payload, ok := <-pc.reorder.out:
+		if !ok {
+			return 0, nil, fmt.Errorf("multipath: closed")
+		}
+		return copy(b, payload), pc.LocalAddr(), nil
+	case <-pc.closeCh:
+		return 0, nil, fmt.Errorf("multipath: closed")
+	}
+}
+
+// WriteFrom implements common.PacketConn, sending b on K of the N paths,
+// optionally emitting an FEC parity packet once a group fills up.
+func (pc *PacketConn) WriteFrom(b []byte, addr net.Addr) (int, error) {
+	seq := atomic.AddUint32(&pc.seq, 1) - 1
+
+	pc.transmit(header{seq: seq}, b, addr)
+
+	if pc.fecEnc != nil {
+		pc.fecMu.Lock()
+		parity, ready := pc.fecEnc.add(b)
+		pc.fecMu.Unlock()
+		if ready {
+			groupBase := seq - uint32(pc.fecGroup) + 1
+			pc.transmit(header{seq: groupBase, flags: flagParity}, parity, addr)
+		}
+	}
+
+	return len(b), nil
+}
+
+// transmit sends payload, framed with h, on K distinct paths chosen
+// round-robin from the full set of N.
+func (pc *PacketConn) transmit(h header, payload []byte, addr net.Addr) {
+	n := len(pc.paths)
+	start := int(h.seq) % n
+
+	frame := make([]byte, headerSize+len(payload))
+	for i := 0; i < pc.k; i++ {
+		idx := (start + i) % n
+		h.pathID = uint16(idx)
+		h.encode(frame)
+		copy(frame[headerSize:], payload)
+
+		if _, err := pc.paths[idx].WriteFrom(frame, addr); err != nil {
+			pc.statsMu.Lock()
+			pc.stats[idx].dropped++
+			pc.statsMu.Unlock()
+			continue
+		}
+		pc.statsMu.Lock()
+		pc.stats[idx].sent++
+		pc.statsMu.Unlock()
+	}
+}
+
+func (pc *PacketConn) readLoop(idx int, conn common.PacketConn) {
+	defer pc.wg.Done()
+
+	b := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadTo(b)
+		if err != nil {
+			return
+		}
+		pc.localAddrMu.Lock()
+		if pc.localAddr == nil {
+			pc.localAddr = addr
+		}
+		pc.localAddrMu.Unlock()
+
+		h, ok := decodeHeader(b[:n])
+		if !ok {
+			continue
+		}
+		payload := append([]byte(nil), b[headerSize:n]...)
+
+		pc.statsMu.Lock()
+		pc.stats[idx].recv++
+		pc.statsMu.Unlock()
+
+		if h.isParity() {
+			pc.handleParity(h, payload)
+			continue
+		}
+
+		pc.windowMu.Lock()
+		dup := pc.window.seen(h.seq)
+		pc.windowMu.Unlock()
+		if dup {
+			continue
+		}
+
+		if pc.fecGroup > 1 {
+			pc.trackForFEC(h.seq, payload)
+		}
+
+		pc.reorder.push(h.seq, payload)
+
+		select {
+		case <-pc.closeCh:
+			return
+		default:
+		}
+	}
+}
+
+func (pc *PacketConn) groupBase(seq uint32) uint32 {
+	return (seq / uint32(pc.fecGroup)) * uint32(pc.fecGroup)
+}
+
+func (pc *PacketConn) trackForFEC(seq uint32, payload []byte) {
+	base := pc.groupBase(seq)
+
+	pc.fecMu.Lock()
+	defer pc.fecMu.Unlock()
+
+	g, ok := pc.fecRecv[base]
+	if !ok {
+		g = &fecGroupState{data: make([][]byte, pc.fecGroup)}
+		pc.fecRecv[base] = g
+	}
+	idx := int(seq - base)
+	if g.data[idx] == nil {
+		g.data[idx] = payload
+		g.count++
+	}
+	if g.count == pc.fecGroup {
+		delete(pc.fecRecv, base)
+	}
+}
+
+func (pc *PacketConn) handleParity(h header, raw []byte) {
+	lengths, parity, ok := decodeParity(raw)
+	if !ok {
+		return
+	}
+
+	base := h.seq
+
+	pc.fecMu.Lock()
+	g, ok := pc.fecRecv[base]
+	if !ok {
+		g = &fecGroupState{data: make([][]byte, pc.fecGroup)}
+		pc.fecRecv[base] = g
+	}
+	g.parity = parity
+	missing, missingCount := -1, 0
+	for i, d := range g.data {
+		if d == nil {
+			missing = i
+			missingCount++
+		}
+	}
+	recoverable := missingCount == 1
+	data := append([][]byte(nil), g.data...)
+	delete(pc.fecRecv, base)
+	pc.fecMu.Unlock()
+
+	if !recoverable || missing >= len(lengths) {
+		return
+	}
+
+	recovered, ok := recoverMissing(data, parity, lengths[missing])
+	if !ok {
+		return
+	}
+
+	seq := base + uint32(missing)
+	pc.windowMu.Lock()
+	dup := pc.window.seen(seq)
+	pc.windowMu.Unlock()
+	if !dup {
+		pc.reorder.push(seq, recovered)
+	}
+}
+
+// LocalAddr returns the client address the first received datagram came
+// from, matching the other common.PacketConn implementations in netstack.
+func (pc *PacketConn) LocalAddr() net.Addr {
+	pc.localAddrMu.Lock()
+	defer pc.localAddrMu.Unlock()
+	return pc.localAddr
+}
+
+// RemoteAddr implements common.PacketConn using the first path's remote
+// address.
+func (pc *PacketConn) RemoteAddr() net.Addr {
+	if len(pc.paths) == 0 {
+		return nil
+	}
+	return pc.paths[0].RemoteAddr()
+}
+
+// SetReadDeadline implements common.PacketConn, applying the deadline to
+// every underlying path.
+func (pc *PacketConn) SetReadDeadline(t time.Time) error {
+	var firstErr error
+	for _, p := range pc.paths {
+		if err := p.SetReadDeadline(t); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Close closes every underlying path and stops delivering reads.
+func (pc *PacketConn) Close() error {
+	var firstErr error
+	pc.closeOnce.Do(func() {
+		close(pc.closeCh)
+		for _, p := range pc.paths {
+			if err := p.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
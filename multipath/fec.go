@@ -0,0 +1,124 @@
+package multipath
+
+import "encoding/binary"
+
+// fecEncoder XORs together every m consecutive payloads (padded to the
+// widest one in the group) and hands the caller a parity packet once the
+// group is full, so a single lost datagram in that group can be recovered
+// without a retransmit. The parity packet is prefixed with each member's
+// real (unpadded) length so a recovered payload can be truncated back to
+// its original size instead of coming back padded to the group's widest
+// member.
+type fecEncoder struct {
+	m       int
+	group   [][]byte
+	lengths []int
+	maxLen  int
+}
+
+func newFECEncoder(m int) *fecEncoder {
+	return &fecEncoder{m: m}
+}
+
+// add buffers payload into the current FEC group, returning the encoded
+// parity packet once m packets have been collected (and resetting the
+// group).
+func (e *fecEncoder) add(payload []byte) ([]byte, bool) {
+	if e.m <= 1 {
+		return nil, false
+	}
+
+	cp := make([]byte, len(payload))
+	copy(cp, payload)
+	e.group = append(e.group, cp)
+	e.lengths = append(e.lengths, len(cp))
+	if len(cp) > e.maxLen {
+		e.maxLen = len(cp)
+	}
+
+	if len(e.group) < e.m {
+		return nil, false
+	}
+
+	parity := make([]byte, e.maxLen)
+	for _, p := range e.group {
+		xorInto(parity, p)
+	}
+	out := encodeParity(e.lengths, parity)
+
+	e.group = e.group[:0]
+	e.lengths = e.lengths[:0]
+	e.maxLen = 0
+	return out, true
+}
+
+// encodeParity packs lengths (the real, unpadded size of every member of
+// the group, in order) ahead of the XORed parity bytes, so the receiver
+// can truncate a recovered payload back to its original size.
+func encodeParity(lengths []int, parity []byte) []byte {
+	out := make([]byte, 2+2*len(lengths)+len(parity))
+	binary.BigEndian.PutUint16(out[0:2], uint16(len(lengths)))
+	for i, l := range lengths {
+		binary.BigEndian.PutUint16(out[2+2*i:4+2*i], uint16(l))
+	}
+	copy(out[2+2*len(lengths):], parity)
+	return out
+}
+
+// decodeParity reverses encodeParity.
+func decodeParity(b []byte) (lengths []int, parity []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	count := int(binary.BigEndian.Uint16(b[0:2]))
+	need := 2 + 2*count
+	if len(b) < need {
+		return nil, nil, false
+	}
+	lengths = make([]int, count)
+	for i := 0; i < count; i++ {
+		lengths[i] = int(binary.BigEndian.Uint16(b[2+2*i : 4+2*i]))
+	}
+	return lengths, b[need:], true
+}
+
+// recoverMissing reconstructs a single missing payload in a group of m data
+// packets (at most one of which may be absent, marked nil in present)
+// given the others plus the parity packet, treating each as zero-padded to
+// the longest of them.
+// The result is truncated to missingLen, the original payload's real size.
+func recoverMissing(present [][]byte, parity []byte, missingLen int) ([]byte, bool) {
+	missing := -1
+	maxLen := len(parity)
+	for i, p := range present {
+		if p == nil {
+			if missing != -1 {
+				return nil, false // more than one missing: unrecoverable
+			}
+			missing = i
+			continue
+		}
+		if len(p) > maxLen {
+			maxLen = len(p)
+		}
+	}
+	if missing == -1 || parity == nil || missingLen > maxLen {
+		return nil, false
+	}
+
+	out := make([]byte, maxLen)
+	xorInto(out, parity)
+	for i, p := range present {
+		if i == missing {
+			continue
+		}
+		xorInto(out, p)
+	}
+	return out[:missingLen], true
+}
+
+func xorInto(dst, src []byte) {
+	for i, b := range src {
+		dst[i] ^= b
+	}
+}
@@ -0,0 +1,82 @@
+package multipath
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFECEncoderGroupsAndResets(t *testing.T) {
+	enc := newFECEncoder(3)
+
+	if _, ready := enc.add([]byte("a")); ready {
+		t.Fatal("parity should not be ready before the group fills up")
+	}
+	if _, ready := enc.add([]byte("bb")); ready {
+		t.Fatal("parity should not be ready before the group fills up")
+	}
+	parity, ready := enc.add([]byte("ccc"))
+	if !ready {
+		t.Fatal("parity should be ready once the group is full")
+	}
+	if len(enc.group) != 0 {
+		t.Fatal("group should reset after emitting parity")
+	}
+
+	lengths, _, ok := decodeParity(parity)
+	if !ok {
+		t.Fatal("decodeParity failed on encoder output")
+	}
+	if !bytesEqualLengths(lengths, []int{1, 2, 3}) {
+		t.Fatalf("lengths = %v, want [1 2 3]", lengths)
+	}
+}
+
+func bytesEqualLengths(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecoverMissingTruncatesToOriginalLength(t *testing.T) {
+	enc := newFECEncoder(2)
+	a := []byte("x")      // shorter payload, the one we'll "lose"
+	b := []byte("hello!") // longer payload, pads the parity to len 6
+
+	enc.add(a)
+	parityFrame, ready := enc.add(b)
+	if !ready {
+		t.Fatal("expected parity after two adds")
+	}
+
+	lengths, parity, ok := decodeParity(parityFrame)
+	if !ok {
+		t.Fatal("decodeParity failed")
+	}
+
+	present := [][]byte{nil, b} // a is missing
+	recovered, ok := recoverMissing(present, parity, lengths[0])
+	if !ok {
+		t.Fatal("recoverMissing failed")
+	}
+	if !bytes.Equal(recovered, a) {
+		t.Fatalf("recovered = %q, want %q (no trailing padding)", recovered, a)
+	}
+}
+
+func TestRecoverMissingRequiresExactlyOneGap(t *testing.T) {
+	present := [][]byte{nil, nil, []byte("c")}
+	if _, ok := recoverMissing(present, make([]byte, 1), 1); ok {
+		t.Fatal("recovery should fail when more than one payload is missing")
+	}
+
+	present = [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	if _, ok := recoverMissing(present, make([]byte, 1), 1); ok {
+		t.Fatal("recovery should fail when nothing is missing")
+	}
+}
@@ -0,0 +1,44 @@
+// Package multipath implements a redundant common.PacketConn that spreads
+// each datagram across several underlying egress paths, with an optional
+// XOR parity stream and a small reorder buffer to smooth out path skew. It
+// targets flaky long-haul links where losing a single UDP datagram (DNS,
+// QUIC) otherwise stalls the flow.
+package multipath
+
+import "encoding/binary"
+
+// headerSize is the 8-byte header multipath.PacketConn prepends to every
+// datagram: 4-byte sequence number, 2-byte path ID, 2-byte flags.
+const headerSize = 8
+
+const (
+	// flagParity marks a packet as FEC parity rather than real payload.
+	flagParity uint16 = 1 << 0
+)
+
+type header struct {
+	seq    uint32
+	pathID uint16
+	flags  uint16
+}
+
+func (h header) encode(b []byte) {
+	binary.BigEndian.PutUint32(b[0:4], h.seq)
+	binary.BigEndian.PutUint16(b[4:6], h.pathID)
+	binary.BigEndian.PutUint16(b[6:8], h.flags)
+}
+
+func decodeHeader(b []byte) (header, bool) {
+	if len(b) < headerSize {
+		return header{}, false
+	}
+	return header{
+		seq:    binary.BigEndian.Uint32(b[0:4]),
+		pathID: binary.BigEndian.Uint16(b[4:6]),
+		flags:  binary.BigEndian.Uint16(b[6:8]),
+	}, true
+}
+
+func (h header) isParity() bool {
+	return h.flags&flagParity != 0
+}
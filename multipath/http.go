@@ -0,0 +1,28 @@
+package multipath
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// pathStatus is the JSON shape reported by ServeHTTP for one path.
+type pathStatus struct {
+	Path    int    `json:"path"`
+	Sent    uint64 `json:"sent"`
+	Recv    uint64 `json:"recv"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// ServeHTTP reports per-path packet counters, using the same JSON-over-HTTP
+// shape as pool.Pool so both can be mounted on the same stats endpoint.
+func (pc *PacketConn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pc.statsMu.Lock()
+	status := make([]pathStatus, len(pc.stats))
+	for i, s := range pc.stats {
+		status[i] = pathStatus{Path: i, Sent: s.sent, Recv: s.recv, Dropped: s.dropped}
+	}
+	pc.statsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,81 @@
+package multipath
+
+import (
+	"sync"
+	"time"
+)
+
+// reorderBuffer holds out-of-order datagrams for up to delay before
+// delivering them anyway, so a few milliseconds of skew between paths
+// doesn't get passed on to the application. It delivers strictly in
+// sequence order when packets arrive within delay of each other; a
+// packet whose predecessor never arrives is force-delivered once its own
+// timer fires, which can produce a gap rather than indefinitely stalling
+// the flow.
+type reorderBuffer struct {
+	delay time.Duration
+	out   chan []byte
+
+	mu      sync.Mutex
+	pending map[uint32][]byte
+	nextSeq uint32
+	started bool
+}
+
+func newReorderBuffer(delay time.Duration, bufSize int) *reorderBuffer {
+	return &reorderBuffer{
+		delay:   delay,
+		out:     make(chan []byte, bufSize),
+		pending: make(map[uint32][]byte),
+	}
+}
+
+// push admits a newly-received, de-duplicated payload for seq.
+func (r *reorderBuffer) push(seq uint32, payload []byte) {
+	r.mu.Lock()
+	if !r.started {
+		r.nextSeq = seq
+		r.started = true
+	}
+	r.pending[seq] = payload
+	r.deliverReadyLocked()
+	r.mu.Unlock()
+
+	time.AfterFunc(r.delay, func() { r.forceDeliver(seq) })
+}
+
+// deliverReadyLocked delivers every contiguously-pending payload starting
+// at nextSeq. It must be called with mu held, and keeps it held for the
+// channel sends themselves so a concurrent forceDeliver can't interleave a
+// send between two of these and reorder what deliverReady was meant to
+// guarantee.
+func (r *reorderBuffer) deliverReadyLocked() {
+	for {
+		payload, ok := r.pending[r.nextSeq]
+		if !ok {
+			return
+		}
+		delete(r.pending, r.nextSeq)
+		r.nextSeq++
+		r.out <- payload
+	}
+}
+
+// forceDeliver is called once a packet's reorder delay has elapsed: if it
+// is still buffered (its predecessors never showed up in time) it is
+// delivered now, skipping the gap.
+func (r *reorderBuffer) forceDeliver(seq uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	payload, ok := r.pending[seq]
+	if !ok {
+		return
+	}
+	delete(r.pending, seq)
+	if seq >= r.nextSeq {
+		r.nextSeq = seq + 1
+	}
+	r.out <- payload
+	r.deliverReadyLocked()
+}
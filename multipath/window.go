@@ -0,0 +1,59 @@
+package multipath
+
+// dedupWindow is a bitmap sliding window over sequence numbers, used to
+// drop datagrams already delivered by an earlier copy on another path.
+type dedupWindow struct {
+	size uint32
+	bits []uint64
+	high uint32
+	init bool
+}
+
+func newDedupWindow(size uint32) *dedupWindow {
+	return &dedupWindow{size: size, bits: make([]uint64, (size+63)/64)}
+}
+
+// seen reports whether seq was already marked, marking it as seen either
+// way (unless it falls below the window, in which case it is treated as a
+// duplicate of something long gone).
+func (w *dedupWindow) seen(seq uint32) bool {
+	if !w.init {
+		w.init = true
+		w.high = seq
+	}
+
+	if seq > w.high {
+		w.advance(seq - w.high)
+		w.high = seq
+	} else if w.high-seq >= w.size {
+		return true // too old to track: treat as a duplicate
+	}
+
+	offset := w.high - seq
+	idx := offset / 64
+	bit := uint64(1) << (offset % 64)
+
+	dup := w.bits[idx]&bit != 0
+	w.bits[idx] |= bit
+	return dup
+}
+
+// advance slides the window forward by n sequence numbers, clearing the
+// bits that fall out of range.
+func (w *dedupWindow) advance(n uint32) {
+	if n >= w.size {
+		for i := range w.bits {
+			w.bits[i] = 0
+		}
+		return
+	}
+	for i := uint32(0); i < n; i++ {
+		// shift every bit toward "older": bit 0 (newest) becomes bit 1, etc.
+		carry := uint64(0)
+		for j := 0; j < len(w.bits); j++ {
+			next := w.bits[j] >> 63
+			w.bits[j] = (w.bits[j] << 1) | carry
+			carry = next
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package multipath
+
+import "testing"
+
+func TestDedupWindowSeen(t *testing.T) {
+	w := newDedupWindow(64)
+
+	if w.seen(10) {
+		t.Fatal("first sighting of a sequence number must not be a duplicate")
+	}
+	if !w.seen(10) {
+		t.Fatal("second sighting of the same sequence number must be a duplicate")
+	}
+
+	if w.seen(11) {
+		t.Fatal("a new, higher sequence number must not be a duplicate")
+	}
+	if !w.seen(10) {
+		t.Fatal("an older, already-seen sequence number must still read as a duplicate")
+	}
+}
+
+func TestDedupWindowTooOldIsTreatedAsDuplicate(t *testing.T) {
+	w := newDedupWindow(4)
+
+	w.seen(100)
+	if !w.seen(90) {
+		t.Fatal("a sequence number far enough below the window should be treated as a duplicate")
+	}
+}
+
+func TestDedupWindowAdvanceBeyondSize(t *testing.T) {
+	w := newDedupWindow(8)
+
+	w.seen(1)
+	w.seen(2)
+	// advancing by more than the window size must not panic, even though it
+	// clears every bit previously tracked.
+	if w.seen(1000) {
+		t.Fatal("a fresh, far-advanced sequence number must not be a duplicate")
+	}
+	// 2 now falls far below the window and is treated as a duplicate of
+	// something long gone, regardless of whether it was actually seen.
+	if !w.seen(2) {
+		t.Fatal("a sequence number far below the current window should be treated as a duplicate")
+	}
+}
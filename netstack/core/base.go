@@ -0,0 +1,185 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/imgk/shadow/common"
+)
+
+// ErrNotFake is returned by LookupAddr when addr is not a fake IP handed
+// out by this Stack.
+var ErrNotFake = fmt.Errorf("not a fake ip")
+
+// ErrNotFound is returned by LookupAddr when addr looks like a fake IP but
+// has no (or an expired) mapping.
+var ErrNotFound = fmt.Errorf("fake ip not found")
+
+// Base implements the fake-IP bookkeeping, domain tree lookups and logging
+// shared by every Stack backend, so GVisor and System only have to
+// implement packet I/O.
+type Base struct {
+	*zap.Logger
+
+	tree *common.DomainTree
+
+	mu     sync.RWMutex
+	fake   net.IPNet
+	byFake map[string]string // fake IP -> domain
+	byName map[string]net.IP // domain -> fake IP
+	nextIP uint32
+}
+
+// NewBase builds a Base over the given fake-IP range and domain tree.
+func NewBase(fake net.IPNet, tree *common.DomainTree, logger *zap.Logger) *Base {
+	return &Base{
+		Logger: logger,
+		tree:   tree,
+		fake:   fake,
+		byFake: make(map[string]string),
+		byName: make(map[string]net.IP),
+	}
+}
+
+// Info logs msg at info level, matching the zap.Logger-backed logging the
+// rest of the stack uses.
+func (b *Base) Info(msg string) {
+	if b.Logger != nil {
+		b.Logger.Info(msg)
+	}
+}
+
+// Error logs msg at error level.
+func (b *Base) Error(msg string) {
+	if b.Logger != nil {
+		b.Logger.Error(msg)
+	}
+}
+
+// LookupAddr reverse-resolves a fake IP back to the common.Addr (domain +
+// port) it was handed out for. The port comes from addr itself, since a
+// fake IP is shared across every port a client dials it on.
+func (b *Base) LookupAddr(addr net.Addr) (net.Addr, error) {
+	ip, port := ipPortOf(addr)
+	if ip == nil || !b.fake.Contains(ip) {
+		return nil, ErrNotFake
+	}
+
+	b.mu.RLock()
+	domain, ok := b.byFake[ip.String()]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return common.NewAddr(domain, port), nil
+}
+
+// HandleMessage answers queries for domains in the backend's tree directly,
+// without going to the real resolver: it hands out a stable fake IP drawn
+// from the configured range, remembers the mapping for later LookupAddr
+// calls, and turns m into its own response. Callers (see
+// netstack.Stack.HandleQuery) check m.Response afterward to tell whether
+// the query was answered this way or still needs real resolution.
+func (b *Base) HandleMessage(m *dns.Msg) {
+	if m == nil || m.Response || len(m.Question) == 0 {
+		return
+	}
+
+	q := m.Question[0]
+	if !b.tree.Has(q.Name) {
+		return
+	}
+
+	var rr dns.RR
+	switch q.Qtype {
+	case dns.TypeA:
+		ip := b.allocate(q.Name, false)
+		if ip == nil {
+			return
+		}
+		rr = &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip}
+	case dns.TypeAAAA:
+		ip := b.allocate(q.Name, true)
+		if ip == nil {
+			return
+		}
+		rr = &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: ip}
+	default:
+		return
+	}
+
+	m.Answer = append(m.Answer, rr)
+	m.Rcode = dns.RcodeSuccess
+	m.Response = true
+}
+
+// allocate returns the fake IP handed out for name, minting a new one from
+// the configured range if this is the first time name has been seen. v6
+// selects whether the fake IP must be usable in an AAAA answer; allocate
+// returns nil if the configured range doesn't match (e.g. an AAAA query
+// against an IPv4-only fake pool).
+func (b *Base) allocate(name string, v6 bool) net.IP {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if ip, ok := b.byName[name]; ok {
+		if (ip.To4() != nil) == v6 {
+			return nil
+		}
+		return ip
+	}
+
+	ip := b.nextFakeIP()
+	if ip == nil || (ip.To4() != nil) == v6 {
+		return nil
+	}
+	b.byName[name] = ip
+	b.byFake[ip.String()] = name
+	return ip
+}
+
+// nextFakeIP hands out the next unused address in fake, wrapping around and
+// skipping the network and broadcast addresses. It returns nil once every
+// address in the range is in use.
+func (b *Base) nextFakeIP() net.IP {
+	base := b.fake.IP.To4()
+	if base == nil {
+		return nil
+	}
+	ones, bits := b.fake.Mask.Size()
+	size := uint32(1) << uint32(bits-ones)
+	if size <= 2 {
+		return nil
+	}
+
+	start := binary.BigEndian.Uint32(base)
+	for i := uint32(0); i < size; i++ {
+		b.nextIP++
+		if b.nextIP == 0 || b.nextIP >= size-1 {
+			b.nextIP = 1 // skip the network (.0) and broadcast addresses
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, start+b.nextIP)
+		if _, used := b.byFake[ip.String()]; !used {
+			return ip
+		}
+	}
+	return nil
+}
+
+func ipPortOf(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	default:
+		return nil, 0
+	}
+}
@@ -0,0 +1,92 @@
+package core
+
+import (
+	"net"
+	"testing"
+)
+
+func testBase(t *testing.T, cidr string) *Base {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("parse cidr %q: %v", cidr, err)
+	}
+	return &Base{
+		fake:   *ipnet,
+		byFake: make(map[string]string),
+		byName: make(map[string]net.IP),
+	}
+}
+
+func TestAllocateIsStableForTheSameName(t *testing.T) {
+	b := testBase(t, "198.18.0.0/24")
+
+	first := b.allocate("example.com.", false)
+	if first == nil {
+		t.Fatal("expected an allocated IP")
+	}
+	second := b.allocate("example.com.", false)
+	if !first.Equal(second) {
+		t.Fatalf("allocate should return the same IP for a name already seen, got %v then %v", first, second)
+	}
+}
+
+func TestAllocateSkipsNetworkAndBroadcast(t *testing.T) {
+	b := testBase(t, "198.18.0.0/30") // usable range: .1 and .2 (.0 network, .3 broadcast)
+
+	ip := b.allocate("a.example.com.", false)
+	if ip == nil {
+		t.Fatal("expected an allocated IP")
+	}
+	if ip.Equal(net.ParseIP("198.18.0.0")) || ip.Equal(net.ParseIP("198.18.0.3")) {
+		t.Fatalf("allocate must not hand out the network or broadcast address, got %v", ip)
+	}
+}
+
+func TestAllocateExhaustsThePool(t *testing.T) {
+	b := testBase(t, "198.18.0.0/30") // only 198.18.0.1 and .2 are usable
+
+	names := []string{"a.example.com.", "b.example.com.", "c.example.com."}
+	got := make(map[string]bool)
+	for _, name := range names {
+		ip := b.allocate(name, false)
+		if ip != nil {
+			got[ip.String()] = true
+		}
+	}
+	if len(got) > 2 {
+		t.Fatalf("expected at most 2 distinct usable addresses in a /30, got %d: %v", len(got), got)
+	}
+	if b.allocate("d.example.com.", false) != nil {
+		t.Fatal("expected nil once the pool is exhausted for a brand-new name")
+	}
+}
+
+func TestAllocateRejectsMismatchedAddressFamily(t *testing.T) {
+	b := testBase(t, "198.18.0.0/24") // IPv4-only pool
+
+	if ip := b.allocate("v6.example.com.", true); ip != nil {
+		t.Fatalf("expected nil for an AAAA query against an IPv4-only pool, got %v", ip)
+	}
+}
+
+func TestLookupAddrRoundTripsThroughAllocate(t *testing.T) {
+	b := testBase(t, "198.18.0.0/24")
+
+	ip := b.allocate("example.com.", false)
+	if ip == nil {
+		t.Fatal("expected an allocated IP")
+	}
+
+	addr, err := b.LookupAddr(&net.UDPAddr{IP: ip, Port: 53})
+	if err != nil {
+		t.Fatalf("LookupAddr error: %v", err)
+	}
+	if got := addr.String(); got == "" {
+		t.Fatal("expected a non-empty resolved address")
+	}
+
+	if _, err := b.LookupAddr(&net.UDPAddr{IP: net.ParseIP("8.8.8.8"), Port: 53}); err != ErrNotFake {
+		t.Fatalf("expected ErrNotFake for an address outside the fake range, got %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Package core defines the pluggable IP-stack backend that netstack.Stack
+// sits on top of, plus the two implementations: a full TCP/IP reassembly
+// backend built on gVisor's userspace network stack (core/gvisor,
+// the default), and a lightweight backend that parses headers directly off
+// the TUN device without reassembly (core/system).
+package core
+
+import (
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+
+	"github.com/imgk/shadow/common"
+)
+
+// Device is the TUN device a Stack backend reads raw IP packets from and
+// writes raw IP packets to.
+type Device interface {
+	common.Device
+}
+
+// Conn is a single accepted TCP half of the stack, handed to
+// Handler.Handle.
+type Conn interface {
+	net.Conn
+}
+
+// PacketConn is a UDP flow accepted by the stack, handed to
+// Handler.HandlePacket.
+type PacketConn interface {
+	ReadTo(b []byte) (int, net.Addr, error)
+	WriteFrom(b []byte, addr net.Addr) (int, error)
+	RemoteAddr() net.Addr
+	Close() error
+	SetReadDeadline(t time.Time) error
+}
+
+// Handler receives connections and packets accepted by a Stack backend.
+// netstack.Stack implements Handler and is passed to Start.
+type Handler interface {
+	Handle(conn Conn, target *net.TCPAddr)
+	HandlePacket(conn PacketConn, target *net.UDPAddr)
+}
+
+// Stack is the pluggable IP-stack backend. netstack.Stack embeds a Stack and
+// is otherwise unaware of whether it is backed by gVisor or the system
+// backend: Handle, HandlePacket and HandleQuery are unchanged either way.
+type Stack interface {
+	// Start begins reading packets from dev, dispatching accepted TCP
+	// connections and UDP flows to handler.
+	Start(dev Device, handler Handler, logger *zap.Logger) error
+	// LookupAddr reverse-resolves a fake IP back to its real address. It
+	// returns ErrNotFake if addr is not a fake IP, or ErrNotFound if addr
+	// looks like a fake IP but has no mapping.
+	LookupAddr(addr net.Addr) (net.Addr, error)
+	// HandleMessage lets the backend apply fake-IP rewriting to a parsed
+	// DNS message before or after resolution.
+	HandleMessage(m *dns.Msg)
+	Info(msg string)
+	Error(msg string)
+	// Close stops the backend and releases its resources.
+	Close() error
+	// Metrics reports basic operational counters for the backend.
+	Metrics() Metrics
+}
+
+// Metrics reports basic operational counters for a Stack backend, exposed
+// so both backends can be compared under the same metrics endpoint.
+type Metrics struct {
+	Packets     uint64 // packets read off the TUN device
+	Retransmits uint64 // TCP retransmissions the backend had to perform
+	MemoryBytes uint64 // approximate memory held by the backend's state
+}
+
+// Backend names a Stack implementation selectable via the "backend"
+// configuration knob.
+type Backend string
+
+const (
+	// GVisor is the default backend: full TCP/IP reassembly via gVisor's
+	// userspace network stack.
+	GVisor Backend = "gvisor"
+	// System is a lightweight backend that parses IPv4/IPv6 + TCP/UDP
+	// headers directly off the TUN device and terminates each flow in-process
+	// with its own minimal TCP state machine instead of doing full packet
+	// reassembly; it does not rewrite SYNs toward a loopback listener. It avoids
+	// the per-packet goroutine and buffer overhead of GVisor and is
+	// preferable on low-memory routers.
+	System Backend = "system"
+)
@@ -0,0 +1,82 @@
+package gvisor
+
+import (
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+
+	"github.com/imgk/shadow/netstack/core"
+)
+
+const nicID tcpip.NICID = 1
+
+// newLinkEndpoint wraps dev as a gVisor channel.Endpoint, pumping packets
+// between the TUN device and the endpoint's inbound/outbound queues.
+func newLinkEndpoint(dev core.Device) (*channel.Endpoint, error) {
+	ep := channel.New(512, 1500, "")
+
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, err := dev.Read(b)
+			if err != nil {
+				return
+			}
+			ep.InjectInbound(headerNetworkProtocol(b[:n]), stack.PacketBufferWithBytes(b[:n]))
+		}
+	}()
+
+	return ep, nil
+}
+
+func headerNetworkProtocol(b []byte) tcpip.NetworkProtocolNumber {
+	if len(b) == 0 {
+		return 0
+	}
+	if b[0]>>4 == 6 {
+		return ipv6.ProtocolNumber
+	}
+	return ipv4.ProtocolNumber
+}
+
+// newGVisorStack wires a gVisor stack.Stack with IPv4/IPv6 + TCP/UDP over
+// ep, forwarding every accepted TCP connection and UDP flow to handler.
+func newGVisorStack(ep stack.LinkEndpoint, handler core.Handler, base *core.Base) (*stack.Stack, error) {
+	st := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	if err := st.CreateNIC(nicID, ep); err != nil {
+		return nil, fmt.Errorf("create nic error: %v", err)
+	}
+	st.SetPromiscuousMode(nicID, true)
+	st.SetSpoofing(nicID, true)
+
+	st.SetRouteTable([]tcpip.Route{
+		{Destination: header4Route(), NIC: nicID},
+		{Destination: header6Route(), NIC: nicID},
+	})
+
+	forwardTCP(st, handler)
+	forwardUDP(st, handler)
+
+	return st, nil
+}
+
+func header4Route() tcpip.Subnet {
+	subnet, _ := tcpip.NewSubnet(tcpip.Address(net.IPv4zero.To4()), tcpip.AddressMask(net.IPv4Mask(0, 0, 0, 0)))
+	return subnet
+}
+
+func header6Route() tcpip.Subnet {
+	subnet, _ := tcpip.NewSubnet(tcpip.Address(net.IPv6zero), tcpip.AddressMask(make([]byte, 16)))
+	return subnet
+}
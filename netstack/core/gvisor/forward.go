@@ -0,0 +1,64 @@
+package gvisor
+
+import (
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+
+	"github.com/imgk/shadow/netstack/core"
+)
+
+// forwardTCP registers a TCP forwarder that hands every accepted connection
+// to handler.Handle along with its original (pre-NAT) destination.
+func forwardTCP(st *stack.Stack, handler core.Handler) {
+	const maxInFlight = 1024
+	fwd := tcp.NewForwarder(st, 0, maxInFlight, func(r *tcp.ForwarderRequest) {
+		wq, ep, err := r.CreateEndpoint(nil)
+		if err != nil {
+			r.Complete(true)
+			return
+		}
+		r.Complete(false)
+
+		id := r.ID()
+		target := &net.TCPAddr{IP: net.IP(id.LocalAddress), Port: int(id.LocalPort)}
+		conn := gonet.NewTCPConn(wq, ep)
+		handler.Handle(conn, target)
+	})
+	st.SetTransportProtocolHandler(tcp.ProtocolNumber, fwd.HandlePacket)
+}
+
+// forwardUDP registers a UDP forwarder that hands every accepted flow to
+// handler.HandlePacket along with its original (pre-NAT) destination.
+func forwardUDP(st *stack.Stack, handler core.Handler) {
+	fwd := udp.NewForwarder(st, func(r *udp.ForwarderRequest) {
+		wq, ep, err := r.CreateEndpoint()
+		if err != nil {
+			return
+		}
+
+		id := r.ID()
+		target := &net.UDPAddr{IP: net.IP(id.LocalAddress), Port: int(id.LocalPort)}
+		conn := &packetConn{UDPConn: gonet.NewUDPConn(st, wq, ep)}
+		handler.HandlePacket(conn, target)
+	})
+	st.SetTransportProtocolHandler(udp.ProtocolNumber, fwd.HandlePacket)
+}
+
+// packetConn adapts gonet's UDPConn to core.PacketConn's ReadTo/WriteFrom
+// shape.
+type packetConn struct {
+	*gonet.UDPConn
+}
+
+func (c *packetConn) ReadTo(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.UDPConn.ReadFrom(b)
+	return n, addr, err
+}
+
+func (c *packetConn) WriteFrom(b []byte, addr net.Addr) (int, error) {
+	return c.UDPConn.WriteTo(b, addr)
+}
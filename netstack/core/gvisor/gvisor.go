@@ -0,0 +1,68 @@
+// Package gvisor is the default core.Stack backend: a full TCP/IP stack
+// with packet reassembly, built on gVisor's userspace network stack
+// (gvisor.dev/gvisor/pkg/tcpip). It trades some memory and per-packet
+// overhead for correctness on lossy or reordered links.
+package gvisor
+
+import (
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"github.com/imgk/shadow/common"
+	"github.com/imgk/shadow/netstack/core"
+)
+
+// Stack is the gVisor-backed core.Stack implementation.
+type Stack struct {
+	*core.Base
+	stack *stack.Stack
+}
+
+// NewStack builds the gVisor backend over the given fake-IP range and
+// domain tree.
+func NewStack(fake net.IPNet, tree *common.DomainTree) *Stack {
+	return &Stack{Base: core.NewBase(fake, tree, nil)}
+}
+
+// Start attaches dev to the gVisor stack and begins dispatching accepted
+// TCP connections and UDP flows to handler.
+func (s *Stack) Start(dev core.Device, handler core.Handler, logger *zap.Logger) error {
+	s.Base.Logger = logger
+
+	ep, err := newLinkEndpoint(dev)
+	if err != nil {
+		return fmt.Errorf("create link endpoint error: %w", err)
+	}
+
+	st, err := newGVisorStack(ep, handler, s.Base)
+	if err != nil {
+		return fmt.Errorf("create gvisor stack error: %w", err)
+	}
+	s.stack = st
+
+	return nil
+}
+
+// Close tears down the gVisor stack and releases its endpoints.
+func (s *Stack) Close() error {
+	if s.stack != nil {
+		s.stack.Close()
+	}
+	return nil
+}
+
+// Metrics reports packet and retransmit counters from gVisor's own NIC and
+// TCP statistics.
+func (s *Stack) Metrics() core.Metrics {
+	if s.stack == nil {
+		return core.Metrics{}
+	}
+	stats := s.stack.Stats()
+	return core.Metrics{
+		Packets:     stats.NICs.Rx.Packets.Value(),
+		Retransmits: stats.TCP.Retransmits.Value(),
+	}
+}
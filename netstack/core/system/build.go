@@ -0,0 +1,111 @@
+package system
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// buildIPv4TCP assembles a complete IPv4/TCP segment from src to dst with
+// the given flags/seq/ack/window and payload, computing the IP and TCP
+// checksums. It targets the common, non-fragmented case this backend
+// actually needs to emit: handshake and data segments back to the TUN
+// device.
+func buildIPv4TCP(src, dst net.IP, srcPort, dstPort uint16, seq, ack uint32, flags uint8, window uint16, payload []byte) []byte {
+	src4 := src.To4()
+	dst4 := dst.To4()
+
+	tcpLen := 20 + len(payload)
+	totalLen := 20 + tcpLen
+	b := make([]byte, totalLen)
+
+	// IPv4 header
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(totalLen))
+	b[8] = 64 // TTL
+	b[9] = protoTCP
+	copy(b[12:16], src4)
+	copy(b[16:20], dst4)
+	binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b[:20]))
+
+	// TCP header
+	tcp := b[20:]
+	binary.BigEndian.PutUint16(tcp[0:2], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	binary.BigEndian.PutUint32(tcp[8:12], ack)
+	tcp[12] = 5 << 4 // data offset, no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:16], window)
+	copy(tcp[20:], payload)
+	binary.BigEndian.PutUint16(tcp[16:18], tcpChecksum(src4, dst4, tcp))
+
+	return b
+}
+
+// buildIPv4UDP assembles a complete IPv4/UDP datagram from src to dst,
+// computing the IP and UDP checksums.
+func buildIPv4UDP(src, dst net.IP, srcPort, dstPort uint16, payload []byte) []byte {
+	src4 := src.To4()
+	dst4 := dst.To4()
+
+	udpLen := 8 + len(payload)
+	totalLen := 20 + udpLen
+	b := make([]byte, totalLen)
+
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:4], uint16(totalLen))
+	b[8] = 64 // TTL
+	b[9] = protoUDP
+	copy(b[12:16], src4)
+	copy(b[16:20], dst4)
+	binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b[:20]))
+
+	udp := b[20:]
+	binary.BigEndian.PutUint16(udp[0:2], srcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen))
+	copy(udp[8:], payload)
+	binary.BigEndian.PutUint16(udp[6:8], udpChecksum(src4, dst4, udp))
+
+	return b
+}
+
+func udpChecksum(src, dst net.IP, segment []byte) uint16 {
+	pseudo := make([]byte, 12+len(segment))
+	copy(pseudo[0:4], src)
+	copy(pseudo[4:8], dst)
+	pseudo[9] = protoUDP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(segment)))
+	copy(pseudo[12:], segment)
+	return checksum(pseudo)
+}
+
+func ipv4Checksum(header []byte) uint16 {
+	return checksum(header)
+}
+
+func tcpChecksum(src, dst net.IP, segment []byte) uint16 {
+	pseudo := make([]byte, 12+len(segment))
+	copy(pseudo[0:4], src)
+	copy(pseudo[4:8], dst)
+	pseudo[9] = protoTCP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(segment)))
+	copy(pseudo[12:], segment)
+	return checksum(pseudo)
+}
+
+// checksum computes the Internet checksum (RFC 1071) over b, treating a
+// trailing odd byte as padded with zero.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
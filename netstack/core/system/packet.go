@@ -0,0 +1,133 @@
+package system
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// fourTuple identifies a TCP or UDP flow by the source and destination of
+// the client's packets; reverse gives the tuple for the other direction.
+type fourTuple struct {
+	srcIP   string
+	srcPort uint16
+	dstIP   string
+	dstPort uint16
+}
+
+func reverse(t fourTuple) fourTuple {
+	return fourTuple{srcIP: t.dstIP, srcPort: t.dstPort, dstIP: t.srcIP, dstPort: t.srcPort}
+}
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// ipPacket is a parsed view into an IPv4 or IPv6 packet, pointing back into
+// the original buffer so payloads can be rewritten and re-transmitted
+// without an extra copy.
+type ipPacket struct {
+	version  int
+	protocol uint8
+	srcIP    net.IP
+	dstIP    net.IP
+	payload  []byte // transport-layer segment (TCP/UDP header + data)
+}
+
+// parseIP parses the IPv4/IPv6 header of b, returning the transport-layer
+// payload. It returns ok=false for fragments, IP versions other than 4 and
+// 6, and truncated packets; the transport protocol is not checked here.
+func parseIP(b []byte) (ipPacket, bool) {
+	if len(b) < 1 {
+		return ipPacket{}, false
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return ipPacket{}, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return ipPacket{}, false
+		}
+		// fragmented packets are not reassembled by this backend
+		if b[6]&0x20 != 0 || binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			return ipPacket{}, false
+		}
+		return ipPacket{
+			version:  4,
+			protocol: b[9],
+			srcIP:    net.IP(b[12:16]),
+			dstIP:    net.IP(b[16:20]),
+			payload:  b[ihl:],
+		}, true
+	case 6:
+		if len(b) < 40 {
+			return ipPacket{}, false
+		}
+		return ipPacket{
+			version:  6,
+			protocol: b[6],
+			srcIP:    net.IP(b[8:24]),
+			dstIP:    net.IP(b[24:40]),
+			payload:  b[40:],
+		}, true
+	default:
+		return ipPacket{}, false
+	}
+}
+
+// tcpHeader is a parsed view into a TCP segment.
+type tcpHeader struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   uint8
+	window  uint16
+	data    []byte
+}
+
+const (
+	flagFIN = 1 << 0
+	flagSYN = 1 << 1
+	flagRST = 1 << 2
+	flagACK = 1 << 4
+)
+
+func parseTCP(b []byte) (tcpHeader, bool) {
+	if len(b) < 20 {
+		return tcpHeader{}, false
+	}
+	offset := int(b[12]>>4) * 4
+	if offset < 20 || len(b) < offset {
+		return tcpHeader{}, false
+	}
+	return tcpHeader{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		data:    b[offset:],
+	}, true
+}
+
+type udpHeader struct {
+	srcPort uint16
+	dstPort uint16
+	data    []byte
+}
+
+func parseUDP(b []byte) (udpHeader, bool) {
+	if len(b) < 8 {
+		return udpHeader{}, false
+	}
+	return udpHeader{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		data:    b[8:],
+	}, true
+}
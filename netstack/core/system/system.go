@@ -0,0 +1,142 @@
+// Package system is a lightweight core.Stack backend that parses IPv4/IPv6
+// and TCP/UDP headers directly off the TUN device instead of doing full
+// gVisor-style packet reassembly. It keeps its own TCP half-connection
+// table keyed on the 4-tuple, terminates the handshake itself with a
+// from-scratch, in-process state machine, and hands handler.Handle a
+// tcpFlow exposing the connection's original destination. This is a
+// minimal, best-effort TCP implementation: there is no retransmission
+// timer and no congestion control, so a lost or reordered segment on the
+// TUN path stalls or corrupts the flow rather than recovering the way a
+// kernel TCP stack would. It trades that correctness for avoiding the
+// per-packet goroutine and buffer overhead of the gVisor backend, an
+// acceptable trade only on low-memory routers talking to well-behaved
+// local clients over a reliable link.
+package system
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+
+	"github.com/imgk/shadow/common"
+	"github.com/imgk/shadow/netstack/core"
+)
+
+// Stack is the system core.Stack backend.
+type Stack struct {
+	*core.Base
+
+	dev     core.Device
+	handler core.Handler
+
+	tcpMu sync.Mutex
+	tcp   map[fourTuple]*tcpFlow
+
+	udpMu sync.Mutex
+	udp   map[fourTuple]*udpSession
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+
+	packets uint64
+}
+
+// NewStack builds the system backend over the given fake-IP range and
+// domain tree.
+func NewStack(fake net.IPNet, tree *common.DomainTree) *Stack {
+	return &Stack{
+		Base:    core.NewBase(fake, tree, nil),
+		tcp:     make(map[fourTuple]*tcpFlow),
+		udp:     make(map[fourTuple]*udpSession),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Start begins reading raw IP packets from dev and splicing TCP/UDP flows
+// to handler.
+func (s *Stack) Start(dev core.Device, handler core.Handler, logger *zap.Logger) error {
+	s.Base.Logger = logger
+	s.dev = dev
+	s.handler = handler
+
+	go s.readLoop()
+	return nil
+}
+
+// Close stops the backend, closing every live flow.
+func (s *Stack) Close() error {
+	s.closeOnce.Do(func() { close(s.closeCh) })
+
+	// f.Close removes f from s.tcp under tcpMu, so collect the flows first
+	s.tcpMu.Lock()
+	flows := make([]*tcpFlow, 0, len(s.tcp))
+	for _, f := range s.tcp {
+		flows = append(flows, f)
+	}
+	s.tcpMu.Unlock()
+
+	for _, f := range flows {
+		f.Close()
+	}
+	return nil
+}
+
+func (s *Stack) readLoop() {
+	b := make([]byte, 65535)
+	for {
+		n, err := s.dev.Read(b)
+		if err != nil {
+			s.Error(fmt.Sprintf("read from tun error: %v", err))
+			return
+		}
+		atomic.AddUint64(&s.packets, 1)
+
+		// copy out of the shared read buffer: each flow keeps packets
+		// around until they have been consumed by handler.Handle
+		raw := make([]byte, n)
+		copy(raw, b[:n])
+
+		pkt, ok := parseIP(raw)
+		if !ok {
+			continue
+		}
+
+		switch pkt.protocol {
+		case protoTCP:
+			s.handleTCP(pkt)
+		case protoUDP:
+			s.handleUDP(pkt)
+		}
+	}
+}
+
+// writeOut writes a fully-formed IP packet back out the TUN device.
+func (s *Stack) writeOut(b []byte) {
+	if _, err := s.dev.Write(b); err != nil {
+		s.Error(fmt.Sprintf("write to tun error: %v", err))
+	}
+}
+
+// approxFlowBytes is a rough per-flow memory estimate used for Metrics: a
+// tcpFlow/udpSession plus its buffered channel, not an exact accounting.
+const approxFlowBytes = 4096
+
+// Metrics reports packets read and an approximate memory footprint. The
+// system backend never retransmits, so Retransmits is always 0.
+func (s *Stack) Metrics() core.Metrics {
+	s.tcpMu.Lock()
+	tcpFlows := len(s.tcp)
+	s.tcpMu.Unlock()
+
+	s.udpMu.Lock()
+	udpSessions := len(s.udp)
+	s.udpMu.Unlock()
+
+	return core.Metrics{
+		Packets:     atomic.LoadUint64(&s.packets),
+		MemoryBytes: uint64(tcpFlows+udpSessions) * approxFlowBytes,
+	}
+}
@@ -0,0 +1,276 @@
+package system
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const tcpWindow = 65535
+
+type tcpState int
+
+const (
+	stateSynRcvd tcpState = iota
+	stateEstablished
+	stateClosed
+)
+
+// tcpFlow is a single TCP half-connection terminated in-process by the
+// system backend's own hand-rolled state machine (see the package doc for
+// its limitations). It implements net.Conn (core.Conn) so it can be handed
+// straight to handler.Handle: reads return payload bytes the real client
+// sent, writes are turned into TCP segments sent back to the client over
+// the TUN device.
+type tcpFlow struct {
+	stack *Stack
+	tuple fourTuple
+
+	srcIP net.IP
+	dstIP net.IP
+
+	mu     sync.Mutex
+	state  tcpState
+	sndNxt uint32 // next sequence number we will send
+	rcvNxt uint32 // next sequence number we expect from the peer
+
+	inbound   chan []byte
+	pending   []byte // leftover bytes from a partial Read
+	closeOnce sync.Once
+	closeCh   chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newTCPFlow(s *Stack, t fourTuple, srcIP, dstIP net.IP, rcvNxt, sndNxt uint32) *tcpFlow {
+	return &tcpFlow{
+		stack:   s,
+		tuple:   t,
+		srcIP:   srcIP,
+		dstIP:   dstIP,
+		state:   stateSynRcvd,
+		sndNxt:  sndNxt,
+		rcvNxt:  rcvNxt,
+		inbound: make(chan []byte, 64),
+		closeCh: make(chan struct{}),
+	}
+}
+
+func (f *tcpFlow) send(flags uint8, payload []byte) {
+	f.mu.Lock()
+	seq := f.sndNxt
+	ack := f.rcvNxt
+	f.mu.Unlock()
+
+	pkt := buildIPv4TCP(f.dstIP, f.srcIP, f.tuple.dstPort, f.tuple.srcPort, seq, ack, flags, tcpWindow, payload)
+	f.stack.writeOut(pkt)
+}
+
+// deliver is called by the read loop for every segment belonging to this
+// flow once it has passed the handshake.
+func (f *tcpFlow) deliver(h tcpHeader) {
+	if h.flags&flagRST != 0 {
+		f.reset()
+		return
+	}
+
+	if len(h.data) > 0 {
+		f.mu.Lock()
+		f.rcvNxt = h.seq + uint32(len(h.data))
+		f.mu.Unlock()
+
+		data := make([]byte, len(h.data))
+		copy(data, h.data)
+		select {
+		case f.inbound <- data:
+		case <-f.closeCh:
+			return
+		}
+		f.send(flagACK, nil)
+	}
+
+	if h.flags&flagFIN != 0 {
+		f.mu.Lock()
+		f.rcvNxt++
+		f.mu.Unlock()
+		f.send(flagACK, nil)
+		close(f.inbound)
+	}
+}
+
+func (f *tcpFlow) reset() {
+	f.mu.Lock()
+	f.state = stateClosed
+	f.mu.Unlock()
+	f.closeOnce.Do(func() { close(f.closeCh) })
+	f.stack.removeTCP(f.tuple)
+}
+
+// Read implements net.Conn.
+func (f *tcpFlow) Read(b []byte) (int, error) {
+	if len(f.pending) > 0 {
+		n := copy(b, f.pending)
+		f.pending = f.pending[n:]
+		return n, nil
+	}
+
+	var timeout <-chan time.Time
+	f.mu.Lock()
+	if !f.readDeadline.IsZero() {
+		timeout = time.After(time.Until(f.readDeadline))
+	}
+	f.mu.Unlock()
+
+	select {
+	case data, ok := <-f.inbound:
+		if !ok {
+			return 0, io.EOF
+		}
+		n := copy(b, data)
+		if n < len(data) {
+			f.pending = data[n:]
+		}
+		return n, nil
+	case <-timeout:
+		return 0, errTimeout{}
+	case <-f.closeCh:
+		return 0, io.EOF
+	}
+}
+
+// Write implements net.Conn, chunking payload into MSS-sized TCP segments.
+func (f *tcpFlow) Write(b []byte) (int, error) {
+	const mss = 1420
+	written := 0
+	for written < len(b) {
+		end := written + mss
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := b[written:end]
+
+		f.mu.Lock()
+		if f.state == stateClosed {
+			f.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		seq, ack := f.sndNxt, f.rcvNxt
+		f.sndNxt += uint32(len(chunk))
+		f.mu.Unlock()
+
+		pkt := buildIPv4TCP(f.dstIP, f.srcIP, f.tuple.dstPort, f.tuple.srcPort, seq, ack, flagACK, tcpWindow, chunk)
+		f.stack.writeOut(pkt)
+
+		written = end
+	}
+	return written, nil
+}
+
+// Close implements net.Conn, sending a FIN and evicting the flow.
+func (f *tcpFlow) Close() error {
+	f.mu.Lock()
+	already := f.state == stateClosed
+	f.state = stateClosed
+	f.mu.Unlock()
+
+	if already {
+		return nil
+	}
+
+	f.send(flagFIN|flagACK, nil)
+	f.mu.Lock()
+	f.sndNxt++
+	f.mu.Unlock()
+	f.closeOnce.Do(func() { close(f.closeCh) })
+	f.stack.removeTCP(f.tuple)
+	return nil
+}
+
+func (f *tcpFlow) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: f.dstIP, Port: int(f.tuple.dstPort)}
+}
+
+func (f *tcpFlow) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: f.srcIP, Port: int(f.tuple.srcPort)}
+}
+
+func (f *tcpFlow) SetDeadline(t time.Time) error {
+	f.SetReadDeadline(t)
+	f.SetWriteDeadline(t)
+	return nil
+}
+
+func (f *tcpFlow) SetReadDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.readDeadline = t
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *tcpFlow) SetWriteDeadline(t time.Time) error {
+	f.mu.Lock()
+	f.writeDeadline = t
+	f.mu.Unlock()
+	return nil
+}
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
+
+// handleTCP processes one inbound IPv4 TCP segment: starting a new flow on
+// SYN, or routing the segment to an existing one.
+func (s *Stack) handleTCP(pkt ipPacket) {
+	h, ok := parseTCP(pkt.payload)
+	if !ok {
+		return
+	}
+
+	t := fourTuple{srcIP: pkt.srcIP.String(), srcPort: h.srcPort, dstIP: pkt.dstIP.String(), dstPort: h.dstPort}
+
+	s.tcpMu.Lock()
+	flow, exists := s.tcp[t]
+	s.tcpMu.Unlock()
+
+	if !exists {
+		if h.flags&flagSYN == 0 || h.flags&flagACK != 0 {
+			return // only a bare SYN starts a new flow
+		}
+
+		flow = newTCPFlow(s, t, pkt.srcIP, pkt.dstIP, h.seq+1, initialSeq())
+		s.tcpMu.Lock()
+		s.tcp[t] = flow
+		s.tcpMu.Unlock()
+
+		flow.send(flagSYN|flagACK, nil)
+		flow.mu.Lock()
+		flow.sndNxt++
+		flow.state = stateEstablished
+		flow.mu.Unlock()
+
+		target := &net.TCPAddr{IP: pkt.dstIP, Port: int(h.dstPort)}
+		go s.handler.Handle(flow, target)
+		return
+	}
+
+	flow.deliver(h)
+}
+
+func (s *Stack) removeTCP(t fourTuple) {
+	s.tcpMu.Lock()
+	delete(s.tcp, t)
+	s.tcpMu.Unlock()
+}
+
+var seqCounter = uint32(time.Now().UnixNano())
+
+// initialSeq returns a pseudo-random initial sequence number for a new
+// flow we originate the handshake response for.
+func initialSeq() uint32 {
+	return atomic.AddUint32(&seqCounter, 1<<20)
+}
@@ -0,0 +1,139 @@
+package system
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// udpIdleTimeout evicts a UDP session after no packets have been seen in
+// either direction for this long.
+const udpIdleTimeout = time.Minute * 5
+
+// udpSession is a UDP "connection" NAT'd by the system backend: the 4-tuple
+// it was first seen on, kept alive until udpIdleTimeout passes with no
+// traffic. It implements core.PacketConn.
+type udpSession struct {
+	stack *Stack
+	tuple fourTuple
+	srcIP net.IP
+	dstIP net.IP
+
+	inbound chan []byte
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	idle         *time.Timer
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func newUDPSession(s *Stack, t fourTuple, srcIP, dstIP net.IP) *udpSession {
+	sess := &udpSession{
+		stack:   s,
+		tuple:   t,
+		srcIP:   srcIP,
+		dstIP:   dstIP,
+		inbound: make(chan []byte, 64),
+		closeCh: make(chan struct{}),
+	}
+	sess.idle = time.AfterFunc(udpIdleTimeout, func() { sess.Close() })
+	return sess
+}
+
+func (u *udpSession) deliver(data []byte) {
+	u.idle.Reset(udpIdleTimeout)
+
+	b := make([]byte, len(data))
+	copy(b, data)
+	select {
+	case u.inbound <- b:
+	case <-u.closeCh:
+	}
+}
+
+// ReadTo implements core.PacketConn, returning the client's address as seen
+// on the TUN device.
+func (u *udpSession) ReadTo(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	u.mu.Lock()
+	if !u.readDeadline.IsZero() {
+		timeout = time.After(time.Until(u.readDeadline))
+	}
+	u.mu.Unlock()
+
+	select {
+	case data, ok := <-u.inbound:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		n := copy(b, data)
+		return n, &net.UDPAddr{IP: u.srcIP, Port: int(u.tuple.srcPort)}, nil
+	case <-timeout:
+		return 0, nil, errTimeout{}
+	case <-u.closeCh:
+		return 0, nil, io.EOF
+	}
+}
+
+// WriteFrom implements core.PacketConn, sending b back to the client as a
+// UDP datagram sourced from the session's original destination.
+func (u *udpSession) WriteFrom(b []byte, _ net.Addr) (int, error) {
+	u.idle.Reset(udpIdleTimeout)
+	pkt := buildIPv4UDP(u.dstIP, u.srcIP, u.tuple.dstPort, u.tuple.srcPort, b)
+	u.stack.writeOut(pkt)
+	return len(b), nil
+}
+
+func (u *udpSession) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: u.srcIP, Port: int(u.tuple.srcPort)}
+}
+
+func (u *udpSession) SetReadDeadline(t time.Time) error {
+	u.mu.Lock()
+	u.readDeadline = t
+	u.mu.Unlock()
+	return nil
+}
+
+func (u *udpSession) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closeCh)
+		u.idle.Stop()
+		u.stack.removeUDP(u.tuple)
+	})
+	return nil
+}
+
+// handleUDP processes one inbound IPv4 UDP datagram: starting a new
+// session on first sight, or routing the datagram to an existing one.
+func (s *Stack) handleUDP(pkt ipPacket) {
+	h, ok := parseUDP(pkt.payload)
+	if !ok {
+		return
+	}
+
+	t := fourTuple{srcIP: pkt.srcIP.String(), srcPort: h.srcPort, dstIP: pkt.dstIP.String(), dstPort: h.dstPort}
+
+	s.udpMu.Lock()
+	sess, exists := s.udp[t]
+	if !exists {
+		sess = newUDPSession(s, t, pkt.srcIP, pkt.dstIP)
+		s.udp[t] = sess
+	}
+	s.udpMu.Unlock()
+
+	if !exists {
+		target := &net.UDPAddr{IP: pkt.dstIP, Port: int(h.dstPort)}
+		go s.handler.HandlePacket(sess, target)
+	}
+	sess.deliver(h.data)
+}
+
+func (s *Stack) removeUDP(t fourTuple) {
+	s.udpMu.Lock()
+	delete(s.udp, t)
+	s.udpMu.Unlock()
+}
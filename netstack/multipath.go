@@ -0,0 +1,194 @@
+package netstack
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/imgk/shadow/common"
+)
+
+// pipePacketConn is one end of an in-memory common.PacketConn pair, used to
+// hand a registered default handler its own private leg of a flow so
+// several handlers can be fanned out to concurrently (see fanOut) the same
+// way net.Pipe lets pool's prober talk to a common.Handler as if it were a
+// net.Conn.
+type pipePacketConn struct {
+	remote net.Addr
+	send   chan<- []byte
+	recv   <-chan []byte
+
+	closeOnce *sync.Once
+	closeCh   chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// newPipePacketConnPair returns two ends of a pipe, each other's peer: a
+// write on one is a read on the other.
+func newPipePacketConnPair(remote net.Addr) (a, b *pipePacketConn) {
+	ab := make(chan []byte, 64)
+	ba := make(chan []byte, 64)
+	closeCh := make(chan struct{})
+	once := &sync.Once{}
+
+	a = &pipePacketConn{remote: remote, send: ab, recv: ba, closeOnce: once, closeCh: closeCh}
+	b = &pipePacketConn{remote: remote, send: ba, recv: ab, closeOnce: once, closeCh: closeCh}
+	return a, b
+}
+
+func (p *pipePacketConn) ReadTo(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	deadline := p.readDeadline
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+
+	select {
+	case data, ok := <-p.recv:
+		if !ok {
+			return 0, nil, io.EOF
+		}
+		return copy(b, data), p.remote, nil
+	case <-timeout:
+		return 0, nil, errPipeTimeout{}
+	case <-p.closeCh:
+		return 0, nil, io.EOF
+	}
+}
+
+func (p *pipePacketConn) WriteFrom(b []byte, _ net.Addr) (int, error) {
+	cp := make([]byte, len(b))
+	copy(cp, b)
+
+	select {
+	case p.send <- cp:
+		return len(b), nil
+	case <-p.closeCh:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (p *pipePacketConn) RemoteAddr() net.Addr { return p.remote }
+
+func (p *pipePacketConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.readDeadline = t
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *pipePacketConn) Close() error {
+	p.closeOnce.Do(func() { close(p.closeCh) })
+	return nil
+}
+
+type errPipeTimeout struct{}
+
+func (errPipeTimeout) Error() string   { return "pipe read deadline exceeded" }
+func (errPipeTimeout) Timeout() bool   { return true }
+func (errPipeTimeout) Temporary() bool { return true }
+
+// fanOut runs pc's flow through every handler in handlers concurrently,
+// broadcasting every outbound datagram to all of them verbatim and relaying
+// back every response any of them sends, in arrival order, so a single dead
+// or slow handler doesn't stall or drop the flow. Responses are not
+// deduplicated: the client receives one copy from each handler that
+// answers. It blocks until pc or every leg is closed.
+//
+// This deliberately does not route the legs through multipath.PacketConn:
+// that type prepends its own wire header to every datagram and strips one
+// off every datagram it reads, a framing only two multipath-aware peers
+// agree on. The handlers here are opaque common.Handler pipes that neither
+// add nor expect that header, so wiring it in here would corrupt every
+// datagram's payload the moment more than one handler is registered.
+func (s *Stack) fanOut(pc common.PacketConn, handlers []common.Handler) {
+	legs := make([]common.PacketConn, len(handlers))
+	for i, h := range handlers {
+		client, server := newPipePacketConnPair(pc.RemoteAddr())
+		legs[i] = client
+
+		go func(h common.Handler, server common.PacketConn) {
+			if err := h.HandlePacket(server); err != nil {
+				s.Error(fmt.Sprintf("handle udp error: %v", err))
+			}
+			server.Close()
+		}(h, server)
+	}
+
+	relayFanOut(pc, legs)
+}
+
+// relayFanOut copies every datagram read from pc to every leg verbatim,
+// and relays every response read from any leg back to pc, until pc or
+// every leg is closed.
+func relayFanOut(pc common.PacketConn, legs []common.PacketConn) {
+	done := make(chan struct{})
+	var closeOnce sync.Once
+	stop := func() {
+		closeOnce.Do(func() {
+			close(done)
+			for _, leg := range legs {
+				leg.Close()
+			}
+		})
+	}
+	defer stop()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := pc.ReadTo(buf)
+			if err != nil {
+				stop()
+				return
+			}
+			for _, leg := range legs {
+				leg.WriteFrom(buf[:n], addr)
+			}
+		}
+	}()
+
+	recv := make(chan []byte, len(legs))
+	var legsWG sync.WaitGroup
+	legsWG.Add(len(legs))
+	for _, leg := range legs {
+		go func(leg common.PacketConn) {
+			defer legsWG.Done()
+			buf := make([]byte, 65535)
+			for {
+				n, _, err := leg.ReadTo(buf)
+				if err != nil {
+					return
+				}
+				payload := append([]byte(nil), buf[:n]...)
+				select {
+				case recv <- payload:
+				case <-done:
+					return
+				}
+			}
+		}(leg)
+	}
+	go func() {
+		legsWG.Wait()
+		stop()
+	}()
+
+	for {
+		select {
+		case payload := <-recv:
+			if _, err := pc.WriteFrom(payload, pc.RemoteAddr()); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
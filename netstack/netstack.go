@@ -12,6 +12,10 @@ import (
 
 	"github.com/imgk/shadow/common"
 	"github.com/imgk/shadow/netstack/core"
+	"github.com/imgk/shadow/netstack/core/gvisor"
+	"github.com/imgk/shadow/netstack/core/system"
+	"github.com/imgk/shadow/resolver"
+	"github.com/imgk/shadow/router"
 )
 
 func NewPacketConn(conn core.PacketConn, target net.Addr, addr net.Addr, stack *Stack) common.PacketConn {
@@ -77,68 +81,159 @@ func (conn *udpConn) WriteFrom(b []byte, addr net.Addr) (int, error) {
 
 type Stack struct {
 	core.Stack
-	handler common.Handler
+	handler  common.Handler
+	handlers []common.Handler
+	router   *router.Router
 
 	resolver common.Resolver
+	cache    *resolver.Cache
 	tree     *common.DomainTree
 	hijack   bool
 
 	counter uint16
 }
 
-func NewStack(handler common.Handler, resolver common.Resolver, tree *common.DomainTree, hijack bool) *Stack {
+// NewStack builds a Stack that proxies through handlers by default and uses
+// rules to decide, per connection or packet, whether to proxy, let the
+// traffic through directly, or reject it. Rules are evaluated in order; a
+// final MATCH rule (see router.NewFinalRule) is conventionally used to
+// provide the default action when nothing more specific matches.
+//
+// handlers is the default proxy pool used whenever a rule doesn't name its
+// own handler. A single entry behaves as before; with more than one, UDP
+// flows that fall through to the default are fanned out across all of them
+// (see Stack.fanOut) instead of picking just one, so a single dead or slow
+// path doesn't drop the flow. The fan-out sends each datagram verbatim; it
+// does not use multipath.PacketConn, so no sequence header, deduplication
+// or FEC is applied.
+//
+// backend selects the underlying IP-stack implementation: core.GVisor (the
+// default, full packet reassembly) or core.System (a lightweight backend
+// that parses headers directly off the TUN device, preferable on
+// low-memory routers). fake is the address range fake IPs are handed out
+// from. ecs, if non-nil, is injected as the default EDNS Client Subnet on
+// queries that don't already carry one.
+func NewStack(backend core.Backend, fake net.IPNet, handlers []common.Handler, rules []router.Rule, res common.Resolver, tree *common.DomainTree, ecs net.IP, hijack bool) *Stack {
+	var def common.Handler
+	if len(handlers) > 0 {
+		def = handlers[0]
+	}
 	return &Stack{
-		handler:  handler,
-		resolver: resolver,
+		Stack:    newBackend(backend, fake, tree),
+		handler:  def,
+		handlers: handlers,
+		router:   router.NewRouter(rules),
+		resolver: res,
+		cache:    resolver.NewCache(tree, ecs),
 		tree:     tree,
 		hijack:   hijack,
 		counter:  uint16(time.Now().Unix()),
 	}
 }
 
+// newBackend builds the core.Stack implementation named by backend. An
+// unrecognized name falls back to the gVisor backend.
+func newBackend(backend core.Backend, fake net.IPNet, tree *common.DomainTree) core.Stack {
+	switch backend {
+	case core.System:
+		return system.NewStack(fake, tree)
+	default:
+		return gvisor.NewStack(fake, tree)
+	}
+}
+
+// domainOf returns the domain name carried by addr, if any. Fake-IP reverse
+// lookups resolve to a common.Addr that remembers the original domain so
+// domain rules can still fire on flows that only ever saw a fake IP.
+func domainOf(addr net.Addr) string {
+	if a, ok := addr.(common.Addr); ok {
+		return a.Domain()
+	}
+	return ""
+}
+
+func srcIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+func srcPort(addr net.Addr) uint16 {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return uint16(a.Port)
+	case *net.UDPAddr:
+		return uint16(a.Port)
+	default:
+		return 0
+	}
+}
+
+// routeCtx builds the RouteCtx for a flow, filling in Process via a
+// best-effort local lookup (see router.LookupProcess) so a ProcessNameRule
+// can match on it.
+func routeCtx(network string, local net.Addr, dstIP net.IP, port uint16, domain string) router.RouteCtx {
+	ip, p := srcIP(local), srcPort(local)
+	return router.RouteCtx{
+		Network: network,
+		SrcIP:   ip,
+		SrcPort: p,
+		DstIP:   dstIP,
+		Port:    port,
+		Domain:  domain,
+		Process: router.LookupProcess(network, ip, p),
+	}
+}
+
 func (s *Stack) Start(dev common.Device, logger *zap.Logger) error {
 	return s.Stack.Start(dev.(core.Device), s, logger)
 }
 
+// Close stops the router's background cache sweep in addition to the
+// backend's own Close.
+func (s *Stack) Close() error {
+	s.router.Close()
+	return s.Stack.Close()
+}
+
 func (s *Stack) Handle(conn core.Conn, target *net.TCPAddr) {
 	addr, err := s.LookupAddr(target)
-	if err == ErrNotFake {
-		if ip := target.IP.To4(); ip != nil {
-			if (ip[0] == 224) ||
-				(ip[0] == 255 && ip[1] == 255 && ip[2] == 255 && ip[3] == 255) ||
-				(ip[0] == 239 && ip[1] == 255 && ip[2] == 255 && ip[3] == 250) ||
-				(ip[0] == 10) ||
-				(ip[0] == 172 && (ip[1] >= 16 && ip[1] <= 31)) ||
-				(ip[0] == 192 && ip[1] == 168) ||
-				(ip[0] == 169 && ip[1] == 254) {
-				s.Info(fmt.Sprintf("ignore conns to %v", target))
-				conn.Close()
-				return
-			}
-		} else {
-			ip := target.IP.To16()
-			if ip[0] == 0xfe && ip[1] == 0x80 ||
-				(ip[0] == 0xff && ip[1] == 0x02) {
-				s.Info(fmt.Sprintf("ignore conns to %v", target))
-				conn.Close()
-				return
-			}
-		}
-
-		s.Info(fmt.Sprintf("proxyd %v <-TCP-> %v", conn.RemoteAddr(), target))
-		if err := s.handler.Handle(conn, target); err != nil {
-			s.Error(fmt.Sprintf("handle tcp error: %v", err))
-		}
-		return
-	}
 	if err == ErrNotFound {
 		s.Error(fmt.Sprintf("handle tcp error: target %v %v", target, err))
 		conn.Close()
 		return
 	}
 
-	s.Info(fmt.Sprintf("proxyd %v <-TCP-> %v", conn.RemoteAddr(), addr))
-	if err := s.handler.Handle(conn, addr); err != nil {
+	dest := net.Addr(target)
+	ctx := routeCtx("tcp", conn.RemoteAddr(), target.IP, uint16(target.Port), "")
+	if err == nil {
+		dest = addr
+		ctx.Domain = domainOf(addr)
+	}
+
+	action, handler := s.router.Route(ctx)
+	defer s.router.Forget(ctx)
+	switch action {
+	case router.Direct:
+		s.Info(fmt.Sprintf("ignore conns to %v", dest))
+		conn.Close()
+		return
+	case router.Reject:
+		s.Info(fmt.Sprintf("reject conns to %v", dest))
+		conn.Close()
+		return
+	}
+	if handler == nil {
+		handler = s.handler
+	}
+
+	s.Info(fmt.Sprintf("proxyd %v <-TCP-> %v", conn.RemoteAddr(), dest))
+	if err := handler.Handle(conn, dest); err != nil {
 		s.Error(fmt.Sprintf("handle tcp error: %v", err))
 	}
 	return
@@ -147,9 +242,7 @@ func (s *Stack) Handle(conn core.Conn, target *net.TCPAddr) {
 func (s *Stack) HandlePacket(conn core.PacketConn, target *net.UDPAddr) {
 	if target == nil {
 		s.Info(fmt.Sprintf("proxyd %v <-UDP-> 0.0.0.0:0", conn.RemoteAddr()))
-		if err := s.handler.HandlePacket(NewPacketConn(conn, nil, nil, s)); err != nil {
-			s.Error(fmt.Sprintf("handle udp error: %v", err))
-		}
+		s.servePacket(s.handler, true, NewPacketConn(conn, nil, nil, s))
 		return
 	}
 
@@ -164,40 +257,63 @@ func (s *Stack) HandlePacket(conn core.PacketConn, target *net.UDPAddr) {
 			s.HandleQuery(conn)
 			return
 		}
-		if ip := target.IP.To4(); ip != nil {
-			if (ip[0] == 224) ||
-				(ip[0] == 255 && ip[1] == 255 && ip[2] == 255 && ip[3] == 255) ||
-				(ip[0] == 239 && ip[1] == 255 && ip[2] == 255 && ip[3] == 250) ||
-				(ip[0] == 10) ||
-				(ip[0] == 172 && (ip[1] >= 16 && ip[1] <= 31)) ||
-				(ip[0] == 192 && ip[1] == 168) ||
-				(ip[0] == 169 && ip[1] == 254) {
-				s.Info(fmt.Sprintf("ignore packets to %v", target))
-				conn.Close()
-				return
-			}
-		} else {
-			ip := target.IP.To16()
-			if ip[0] == 0xfe && ip[1] == 0x80 ||
-				(ip[0] == 0xff && ip[1] == 0x02) {
-				s.Info(fmt.Sprintf("ignore packets to %v", target))
-				conn.Close()
-				return
-			}
+
+		ctx := routeCtx("udp", conn.RemoteAddr(), target.IP, uint16(target.Port), "")
+		action, handler := s.router.Route(ctx)
+		defer s.router.Forget(ctx)
+		switch action {
+		case router.Direct:
+			s.Info(fmt.Sprintf("ignore packets to %v", target))
+			conn.Close()
+			return
+		case router.Reject:
+			s.Info(fmt.Sprintf("reject packets to %v", target))
+			conn.Close()
+			return
+		}
+		useDefault := handler == nil
+		if handler == nil {
+			handler = s.handler
 		}
 
 		s.Info(fmt.Sprintf("proxyd %v <-UDP-> %v", conn.RemoteAddr(), target))
-		if err := s.handler.HandlePacket(NewPacketConn(conn, nil, nil, s)); err != nil {
-			s.Error(fmt.Sprintf("handle udp error: %v", err))
-		}
+		s.servePacket(handler, useDefault, NewPacketConn(conn, nil, nil, s))
 		return
 	}
 
+	ctx := routeCtx("udp", conn.RemoteAddr(), target.IP, uint16(target.Port), domainOf(addr))
+	action, handler := s.router.Route(ctx)
+	defer s.router.Forget(ctx)
+	switch action {
+	case router.Direct:
+		s.Info(fmt.Sprintf("ignore packets to %v", addr))
+		return
+	case router.Reject:
+		s.Info(fmt.Sprintf("reject packets to %v", addr))
+		return
+	}
+	useDefault := handler == nil
+	if handler == nil {
+		handler = s.handler
+	}
+
 	s.Info(fmt.Sprintf("proxyd %v <-UDP-> %v", conn.RemoteAddr(), addr))
-	if err := s.handler.HandlePacket(NewPacketConn(conn, target, addr, s)); err != nil {
+	s.servePacket(handler, useDefault, NewPacketConn(conn, target, addr, s))
+	return
+}
+
+// servePacket dispatches pc to handler. If handler is the fallback default
+// (usingDefault) and more than one default handler is registered, the flow
+// is fanned out across all of them via Stack.fanOut instead of running
+// through just the one.
+func (s *Stack) servePacket(handler common.Handler, usingDefault bool, pc common.PacketConn) {
+	if usingDefault && len(s.handlers) > 1 {
+		s.fanOut(pc, s.handlers)
+		return
+	}
+	if err := handler.HandlePacket(pc); err != nil {
 		s.Error(fmt.Sprintf("handle udp error: %v", err))
 	}
-	return
 }
 
 // handle dns queries
@@ -244,8 +360,22 @@ func (s *Stack) HandleQuery(conn core.PacketConn) {
 				continue
 			}
 			n = len(bb)
+		} else if resp, ok := s.cache.Get(&m, func() { s.prefetch(m.Copy()) }); ok {
+			bb, err := resp.PackBuffer(b[2:])
+			if err != nil {
+				s.Error("append message error: " + err.Error())
+				continue
+			}
+			n = len(bb)
 		} else {
-			nr, err := s.resolver.Resolve(b, n)
+			s.cache.InjectECS(&m)
+			qb, err := m.PackBuffer(b[2:])
+			if err != nil {
+				s.Error("append message error: " + err.Error())
+				continue
+			}
+
+			nr, err := s.resolver.Resolve(b, len(qb))
 			if err != nil {
 				if ne := net.Error(nil); errors.As(err, &ne) {
 					if ne.Timeout() {
@@ -256,6 +386,11 @@ func (s *Stack) HandleQuery(conn core.PacketConn) {
 				continue
 			}
 			n = nr
+
+			resp := dns.Msg{}
+			if err := resp.Unpack(b[2 : 2+n]); err == nil {
+				s.cache.Set(&m, &resp)
+			}
 		}
 
 		if _, err := conn.WriteFrom(b[2:2+n], addr); err != nil {
@@ -264,3 +399,31 @@ func (s *Stack) HandleQuery(conn core.PacketConn) {
 		}
 	}
 }
+
+// prefetch re-resolves query in the background and refreshes the cache
+// entry, used when Cache.Get serves an answer that is close to expiring.
+func (s *Stack) prefetch(query *dns.Msg) {
+	slice := common.Get()
+	defer common.Put(slice)
+	b := slice.Get()
+
+	s.cache.InjectECS(query)
+	qb, err := query.PackBuffer(b[2:])
+	if err != nil {
+		s.Error("prefetch pack error: " + err.Error())
+		return
+	}
+
+	nr, err := s.resolver.Resolve(b, len(qb))
+	if err != nil {
+		s.Error("prefetch resolve error: " + err.Error())
+		return
+	}
+
+	resp := dns.Msg{}
+	if err := resp.Unpack(b[2 : 2+nr]); err != nil {
+		s.Error("prefetch unpack error: " + err.Error())
+		return
+	}
+	s.cache.Set(query, &resp)
+}
@@ -0,0 +1,30 @@
+package pool
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// memberStatus is the JSON shape reported by ServeHTTP for one member.
+type memberStatus struct {
+	Name    string `json:"name"`
+	Alive   bool   `json:"alive"`
+	Latency string `json:"latency"`
+}
+
+// ServeHTTP reports the current alive state and latency of every member, so
+// it can be mounted at e.g. "/pool" on a debug mux.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := make([]memberStatus, 0, len(p.members))
+	for _, m := range p.members {
+		alive, latency := m.snapshot()
+		s := memberStatus{Name: m.name, Alive: alive}
+		if alive {
+			s.Latency = latency.String()
+		}
+		status = append(status, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,290 @@
+// Package pool implements a health-checked common.Handler that owns several
+// upstream handlers, probes their latency with periodic URL tests, and
+// picks a live one per Handle/HandlePacket call so a single dead upstream
+// does not take the whole proxy down.
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/imgk/shadow/common"
+)
+
+// Strategy selects how Pick chooses among the currently alive handlers.
+type Strategy int
+
+const (
+	// Fallback always picks the first alive handler in priority order.
+	Fallback Strategy = iota
+	// URLTest picks the alive handler with the lowest probed latency.
+	URLTest
+	// RoundRobin cycles through alive handlers on every Pick.
+	RoundRobin
+	// ConsistentHash picks a handler based on a hash of the target address,
+	// so the same target tends to stick to the same handler.
+	ConsistentHash
+)
+
+// DefaultInterval is how often the pool re-probes all members.
+const DefaultInterval = time.Minute * 5
+
+// DefaultProbeTimeout bounds a single member's probe.
+const DefaultProbeTimeout = time.Second * 5
+
+// DefaultMaxHops bounds how many alternates Handle/HandlePacket try after
+// the picked handler fails with an I/O error.
+const DefaultMaxHops = 2
+
+// ErrNoHandler is returned when every member of the pool is marked dead.
+var ErrNoHandler = errors.New("no alive handler in pool")
+
+type member struct {
+	name    string
+	handler common.Handler
+
+	mu      sync.RWMutex
+	alive   bool
+	latency time.Duration
+}
+
+func (m *member) setResult(latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.alive = err == nil
+	if err == nil {
+		m.latency = latency
+	}
+}
+
+func (m *member) snapshot() (alive bool, latency time.Duration) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.alive, m.latency
+}
+
+// Pool is a common.Handler that multiplexes over a set of named upstream
+// handlers, keeping them health-checked with a latency URL test.
+type Pool struct {
+	members []*member
+
+	strategy Strategy
+	url      string
+	interval time.Duration
+	timeout  time.Duration
+	maxHops  int
+	keepN    int
+
+	rrCounter uint32
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// Option configures a Pool.
+type Option func(*Pool)
+
+// WithStrategy sets the handler selection Strategy. Default is Fallback.
+func WithStrategy(s Strategy) Option {
+	return func(p *Pool) { p.strategy = s }
+}
+
+// WithURLTest sets the URL probed to measure latency and the interval
+// between probe rounds. Default interval is DefaultInterval.
+func WithURLTest(url string, interval time.Duration) Option {
+	return func(p *Pool) {
+		p.url = url
+		if interval > 0 {
+			p.interval = interval
+		}
+	}
+}
+
+// WithProbeTimeout bounds a single member's probe. Default is
+// DefaultProbeTimeout.
+func WithProbeTimeout(timeout time.Duration) Option {
+	return func(p *Pool) { p.timeout = timeout }
+}
+
+// WithMaxHops bounds how many alternates are tried after a failed Handle or
+// HandlePacket call. Default is DefaultMaxHops.
+func WithMaxHops(hops int) Option {
+	return func(p *Pool) { p.maxHops = hops }
+}
+
+// WithKeepAlive keeps only the best n alive handlers eligible for Pick,
+// ranked by latency. 0 (the default) keeps all alive handlers.
+func WithKeepAlive(n int) Option {
+	return func(p *Pool) { p.keepN = n }
+}
+
+// NewPool builds a Pool over the given named handlers and starts its
+// background prober. Call Close to stop probing.
+func NewPool(handlers map[string]common.Handler, opts ...Option) *Pool {
+	p := &Pool{
+		interval: DefaultInterval,
+		timeout:  DefaultProbeTimeout,
+		maxHops:  DefaultMaxHops,
+		url:      "https://www.gstatic.com/generate_204",
+		closeCh:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.members = append(p.members, &member{name: name, handler: handlers[name], alive: true})
+	}
+
+	go p.loop()
+	return p
+}
+
+// Close stops the background prober.
+func (p *Pool) Close() error {
+	p.closeOnce.Do(func() { close(p.closeCh) })
+	return nil
+}
+
+func (p *Pool) loop() {
+	p.probeAll()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.probeAll()
+		case <-p.closeCh:
+			return
+		}
+	}
+}
+
+func (p *Pool) probeAll() {
+	wg := sync.WaitGroup{}
+	wg.Add(len(p.members))
+	for _, m := range p.members {
+		go func(m *member) {
+			defer wg.Done()
+			latency, err := probe(m.handler, p.url, p.timeout)
+			m.setResult(latency, err)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// alive returns the members currently marked alive, in name order (the
+// priority order Fallback uses), trimmed to the keepN best by latency if set.
+func (p *Pool) alive() []*member {
+	alive := make([]*member, 0, len(p.members))
+	for _, m := range p.members {
+		if ok, _ := m.snapshot(); ok {
+			alive = append(alive, m)
+		}
+	}
+	if p.keepN > 0 && len(alive) > p.keepN {
+		keep := make(map[*member]bool, p.keepN)
+		for _, m := range byLatency(alive)[:p.keepN] {
+			keep[m] = true
+		}
+		trimmed := alive[:0]
+		for _, m := range alive {
+			if keep[m] {
+				trimmed = append(trimmed, m)
+			}
+		}
+		alive = trimmed
+	}
+	return alive
+}
+
+// byLatency returns a copy of alive sorted with the lowest measured latency
+// first.
+func byLatency(alive []*member) []*member {
+	sorted := append([]*member(nil), alive...)
+	sort.Slice(sorted, func(i, j int) bool {
+		_, li := sorted[i].snapshot()
+		_, lj := sorted[j].snapshot()
+		return li < lj
+	})
+	return sorted
+}
+
+// Pick returns the member that should be used for target, according to the
+// pool's Strategy.
+func (p *Pool) Pick(target net.Addr) (*member, error) {
+	alive := p.alive()
+	if len(alive) == 0 {
+		return nil, ErrNoHandler
+	}
+
+	switch p.strategy {
+	case RoundRobin:
+		i := int(atomic.AddUint32(&p.rrCounter, 1)) % len(alive)
+		return alive[i], nil
+	case ConsistentHash:
+		h := fnv.New32a()
+		if target != nil {
+			h.Write([]byte(target.String()))
+		}
+		i := int(h.Sum32()) % len(alive)
+		if i < 0 {
+			i += len(alive)
+		}
+		return alive[i], nil
+	case URLTest:
+		return byLatency(alive)[0], nil
+	case Fallback:
+		fallthrough
+	default:
+		return alive[0], nil
+	}
+}
+
+// Handle implements common.Handler, retrying on the next best handler on
+// I/O error, up to maxHops times. A handler that errors is demoted
+// immediately instead of waiting for the next background probe.
+func (p *Pool) Handle(conn net.Conn, target net.Addr) error {
+	var lastErr error
+	for i := 0; i <= p.maxHops; i++ {
+		m, err := p.Pick(target)
+		if err != nil {
+			return err
+		}
+		if lastErr = m.handler.Handle(conn, target); lastErr == nil {
+			return nil
+		}
+		m.setResult(0, lastErr)
+	}
+	return fmt.Errorf("pool handle %v error after %v hops: %w", target, p.maxHops, lastErr)
+}
+
+// HandlePacket implements common.Handler, retrying on the next best handler
+// on I/O error, up to maxHops times. A handler that errors is demoted
+// immediately instead of waiting for the next background probe.
+func (p *Pool) HandlePacket(conn common.PacketConn) error {
+	var lastErr error
+	for i := 0; i <= p.maxHops; i++ {
+		m, err := p.Pick(conn.LocalAddr())
+		if err != nil {
+			return err
+		}
+		if lastErr = m.handler.HandlePacket(conn); lastErr == nil {
+			return nil
+		}
+		m.setResult(0, lastErr)
+	}
+	return fmt.Errorf("pool handle packet error after %v hops: %w", p.maxHops, lastErr)
+}
@@ -0,0 +1,58 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/imgk/shadow/common"
+)
+
+// probe dials url through handler and returns the round-trip latency, or an
+// error if the handler is considered dead for this round.
+func probe(handler common.Handler, url string, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialThrough(ctx, handler, network, addr)
+			},
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("new probe request error: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("probe request error: %w", err)
+	}
+	resp.Body.Close()
+
+	return time.Since(start), nil
+}
+
+// dialThrough connects a pipe to handler.Handle running in the background,
+// so an http.Transport can probe a common.Handler the same way it would
+// probe a real net.Dialer.
+func dialThrough(ctx context.Context, handler common.Handler, network, addr string) (net.Conn, error) {
+	target, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve probe target %v error: %w", addr, err)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		if err := handler.Handle(server, target); err != nil {
+			server.Close()
+		}
+	}()
+	return client, nil
+}
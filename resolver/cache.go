@@ -0,0 +1,183 @@
+package resolver
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/imgk/shadow/common"
+)
+
+// NegativeTTL is the default TTL applied to cached NXDOMAIN/SERVFAIL
+// answers, which otherwise carry no TTL of their own to derive one from.
+const NegativeTTL = time.Second * 30
+
+// prefetchThreshold is the fraction of an entry's original TTL remaining
+// below which a Get triggers a background refresh.
+const prefetchThreshold = 0.10
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+type cacheEntry struct {
+	msg       *dns.Msg
+	expiresAt time.Time
+	ttl       time.Duration // original TTL, to compute the prefetch threshold
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return now.After(e.expiresAt)
+}
+
+// Cache is an in-memory DNS answer cache keyed by (qname, qtype, qclass).
+// It honors the minimum RR TTL for positive answers, a separate shorter TTL
+// for negative answers, per-rule TTL floors from a *common.DomainTree (so
+// fake-IP names never outlive their fake-IP lease), and can inject an EDNS
+// Client Subnet option into outgoing queries that don't carry one.
+type Cache struct {
+	mu      sync.RWMutex
+	entries map[cacheKey]*cacheEntry
+
+	tree *common.DomainTree
+	ecs  net.IP
+
+	negativeTTL time.Duration
+
+	prefetchOnce sync.Map // cacheKey -> struct{}, dedupes concurrent prefetches
+}
+
+// NewCache builds an empty Cache. tree, if non-nil, supplies a minimum TTL
+// floor for fake-IP domains (see MinTTL). ecs, if non-nil, is injected as
+// the default EDNS Client Subnet for queries that didn't set one.
+func NewCache(tree *common.DomainTree, ecs net.IP) *Cache {
+	return &Cache{
+		entries:     make(map[cacheKey]*cacheEntry),
+		tree:        tree,
+		ecs:         ecs,
+		negativeTTL: NegativeTTL,
+	}
+}
+
+func keyOf(q dns.Question) cacheKey {
+	return cacheKey{name: q.Name, qtype: q.Qtype, class: q.Qclass}
+}
+
+// Get returns a cached response for query, with its transaction ID already
+// rewritten to match. refresh is called in the background (at most once per
+// key concurrently) if the entry is within prefetchThreshold of expiring.
+func (c *Cache) Get(query *dns.Msg, refresh func()) (*dns.Msg, bool) {
+	if len(query.Question) == 0 {
+		return nil, false
+	}
+	key := keyOf(query.Question[0])
+
+	c.mu.RLock()
+	e, ok := c.entries[key]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	now := time.Now()
+	if e.expired(now) {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	if remaining := e.expiresAt.Sub(now); e.ttl > 0 && remaining < time.Duration(float64(e.ttl)*prefetchThreshold) {
+		if _, loaded := c.prefetchOnce.LoadOrStore(key, struct{}{}); !loaded {
+			go func() {
+				defer c.prefetchOnce.Delete(key)
+				refresh()
+			}()
+		}
+	}
+
+	resp := e.msg.Copy()
+	resp.Id = query.Id
+	return resp, true
+}
+
+// Set inserts resp as the answer for query, deriving its expiry from the
+// minimum RR TTL (or NegativeTTL for NXDOMAIN/SERVFAIL), floored by any
+// minimum TTL the domain tree requires for this name.
+func (c *Cache) Set(query *dns.Msg, resp *dns.Msg) {
+	if len(query.Question) == 0 {
+		return
+	}
+	key := keyOf(query.Question[0])
+
+	ttl := c.negativeTTL
+	if resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0 {
+		ttl = minTTL(resp)
+	}
+	if floor, ok := c.minTTL(query.Question[0].Name); ok && floor > ttl {
+		ttl = floor
+	}
+
+	c.mu.Lock()
+	c.entries[key] = &cacheEntry{msg: resp.Copy(), expiresAt: time.Now().Add(ttl), ttl: ttl}
+	c.mu.Unlock()
+}
+
+// minTTL asks the domain tree for a minimum TTL floor for name, used to
+// keep fake-IP answers from outliving the fake-IP lease they were rewritten
+// for. A nil tree or a tree with no opinion on name returns ok=false.
+func (c *Cache) minTTL(name string) (time.Duration, bool) {
+	if c.tree == nil {
+		return 0, false
+	}
+	ttl, ok := c.tree.MinTTL(name)
+	return ttl, ok
+}
+
+func minTTL(resp *dns.Msg) time.Duration {
+	min := uint32(0)
+	for i, rr := range resp.Answer {
+		ttl := rr.Header().Ttl
+		if i == 0 || ttl < min {
+			min = ttl
+		}
+	}
+	return time.Duration(min) * time.Second
+}
+
+// InjectECS adds the configured default EDNS Client Subnet option to m if m
+// doesn't already carry one.
+func (c *Cache) InjectECS(m *dns.Msg) {
+	if c.ecs == nil {
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		m.Extra = append(m.Extra, opt)
+	}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return
+		}
+	}
+
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	e.Address = c.ecs
+	if ip4 := c.ecs.To4(); ip4 != nil {
+		e.Family = 1
+		e.SourceNetmask = 24
+	} else {
+		e.Family = 2
+		e.SourceNetmask = 56
+	}
+	opt.Option = append(opt.Option, e)
+}
@@ -0,0 +1,130 @@
+package resolver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answerMsg(name string, ttl uint32, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	if rcode != dns.RcodeSuccess {
+		m.Rcode = rcode
+		return m
+	}
+	rr := &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   net.ParseIP("1.2.3.4").To4(),
+	}
+	m.Answer = append(m.Answer, rr)
+	return m
+}
+
+func TestCacheSetGetRewritesTransactionID(t *testing.T) {
+	c := NewCache(nil, nil)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	c.Set(query, answerMsg("example.com.", 300, dns.RcodeSuccess))
+
+	query2 := new(dns.Msg)
+	query2.SetQuestion("example.com.", dns.TypeA)
+	query2.Id = 42
+
+	got, ok := c.Get(query2, func() {})
+	if !ok {
+		t.Fatal("expected a cache hit")
+	}
+	if got.Id != query2.Id {
+		t.Fatalf("got.Id = %d, want %d", got.Id, query2.Id)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	c := NewCache(nil, nil)
+
+	query := new(dns.Msg)
+	query.SetQuestion("nx.example.com.", dns.TypeA)
+	c.Set(query, answerMsg("nx.example.com.", 0, dns.RcodeNameError))
+
+	c.mu.RLock()
+	e := c.entries[keyOf(query.Question[0])]
+	c.mu.RUnlock()
+	if e == nil || e.ttl != NegativeTTL {
+		t.Fatalf("ttl = %v, want NegativeTTL (%v)", e.ttl, NegativeTTL)
+	}
+}
+
+func TestCacheGetEvictsExpiredEntry(t *testing.T) {
+	c := NewCache(nil, nil)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	key := keyOf(query.Question[0])
+	c.entries[key] = &cacheEntry{
+		msg:       answerMsg("example.com.", 300, dns.RcodeSuccess),
+		expiresAt: time.Now().Add(-time.Second),
+		ttl:       300 * time.Second,
+	}
+
+	if _, ok := c.Get(query, func() {}); ok {
+		t.Fatal("expected a miss for an expired entry")
+	}
+	if _, ok := c.entries[key]; ok {
+		t.Fatal("expired entry should have been evicted from the map")
+	}
+}
+
+func TestCacheGetTriggersPrefetchNearExpiry(t *testing.T) {
+	c := NewCache(nil, nil)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	key := keyOf(query.Question[0])
+	ttl := 100 * time.Second
+	c.entries[key] = &cacheEntry{
+		msg:       answerMsg("example.com.", 100, dns.RcodeSuccess),
+		expiresAt: time.Now().Add(time.Second), // well within prefetchThreshold of ttl
+		ttl:       ttl,
+	}
+
+	var called int32
+	done := make(chan struct{})
+	if _, ok := c.Get(query, func() { atomic.AddInt32(&called, 1); close(done) }); !ok {
+		t.Fatal("expected a hit even when prefetch fires")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected refresh to be called in the background")
+	}
+	if atomic.LoadInt32(&called) != 1 {
+		t.Fatalf("refresh called %d times, want 1", called)
+	}
+}
+
+func TestCacheGetDoesNotPrefetchFarFromExpiry(t *testing.T) {
+	c := NewCache(nil, nil)
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	key := keyOf(query.Question[0])
+	ttl := 100 * time.Second
+	c.entries[key] = &cacheEntry{
+		msg:       answerMsg("example.com.", 100, dns.RcodeSuccess),
+		expiresAt: time.Now().Add(90 * time.Second), // far from prefetchThreshold of ttl
+		ttl:       ttl,
+	}
+
+	var called int32
+	c.Get(query, func() { atomic.AddInt32(&called, 1) })
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt32(&called) != 0 {
+		t.Fatal("refresh should not fire when far from expiry")
+	}
+}
@@ -0,0 +1,59 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DoH is a DNS-over-HTTPS common.Resolver using the RFC 8484 POST format.
+type DoH struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+// NewDoH creates a DoH resolver that POSTs queries to url using client. A
+// nil client uses http.DefaultTransport with the given timeout.
+func NewDoH(url string, client *http.Client, timeout time.Duration) *DoH {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if client == nil {
+		client = &http.Client{Timeout: timeout}
+	}
+	return &DoH{url: url, client: client, timeout: timeout}
+}
+
+// Resolve sends the query packed in b[2:2+n] to the upstream and writes the
+// response back into b[2:], returning the number of response bytes.
+func (r *DoH) Resolve(b []byte, n int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(b[2:2+n]))
+	if err != nil {
+		return 0, fmt.Errorf("new doh request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("doh request to %v error: %w", r.url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("doh upstream %v returned status %v", r.url, resp.Status)
+	}
+
+	nr, err := io.ReadFull(resp.Body, b[2:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, fmt.Errorf("read doh response from %v error: %w", r.url, err)
+	}
+	return nr, nil
+}
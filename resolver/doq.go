@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// DoQ is a DNS-over-QUIC common.Resolver (RFC 9250). Each query opens a new
+// bidirectional stream on a shared, lazily (re)dialed QUIC connection: the
+// handshake cost is paid once, not on every query, and a connection that
+// has gone away is transparently redialed on the next query that needs it.
+type DoQ struct {
+	addr    string
+	tlsConf *tls.Config
+	timeout time.Duration
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+// NewDoQ creates a DoQ resolver dialing addr (host:port) with tlsConf.
+// tlsConf.NextProtos is set to "doq" if empty.
+func NewDoQ(addr string, tlsConf *tls.Config, timeout time.Duration) *DoQ {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	if len(tlsConf.NextProtos) == 0 {
+		tlsConf.NextProtos = []string{"doq"}
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &DoQ{addr: addr, tlsConf: tlsConf, timeout: timeout}
+}
+
+// Resolve sends the query packed in b[2:2+n] to the upstream and writes the
+// response back into b[2:], returning the number of response bytes. It
+// reuses the shared connection across calls, redialing once and retrying
+// if the connection has died since the last query.
+func (r *DoQ) Resolve(b []byte, n int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	conn, err := r.getConn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("dial doq upstream %v error: %w", r.addr, err)
+	}
+
+	nr, err := r.roundTrip(ctx, conn, b, n)
+	if err == nil {
+		return nr, nil
+	}
+
+	r.dropConn(conn)
+	conn, err = r.getConn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("dial doq upstream %v error: %w", r.addr, err)
+	}
+	return r.roundTrip(ctx, conn, b, n)
+}
+
+// getConn returns the shared QUIC connection, dialing one if this is the
+// first query or the previous connection was dropped.
+func (r *DoQ) getConn(ctx context.Context) (quic.Connection, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		return r.conn, nil
+	}
+
+	conn, err := quic.DialAddr(ctx, r.addr, r.tlsConf, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.conn = conn
+	return conn, nil
+}
+
+// dropConn discards conn as the shared connection if it is still the
+// current one, so the next query redials instead of reusing a dead
+// connection.
+func (r *DoQ) dropConn(conn quic.Connection) {
+	r.mu.Lock()
+	if r.conn == conn {
+		r.conn = nil
+	}
+	r.mu.Unlock()
+	conn.CloseWithError(0, "")
+}
+
+// roundTrip opens a new bidirectional stream on conn and runs a single
+// query/response exchange over it.
+func (r *DoQ) roundTrip(ctx context.Context, conn quic.Connection, b []byte, n int) (int, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("open doq stream to %v error: %w", r.addr, err)
+	}
+	stream.SetDeadline(time.Now().Add(r.timeout))
+
+	binary.BigEndian.PutUint16(b, uint16(n))
+	if _, err := stream.Write(b[:2+n]); err != nil {
+		return 0, fmt.Errorf("write to doq upstream %v error: %w", r.addr, err)
+	}
+	// a client MUST send a FIN after the query to signal it has no more data
+	if err := stream.Close(); err != nil {
+		return 0, fmt.Errorf("close doq stream to %v error: %w", r.addr, err)
+	}
+
+	if _, err := readFull(stream, b[:2]); err != nil {
+		return 0, fmt.Errorf("read length from doq upstream %v error: %w", r.addr, err)
+	}
+	nr := int(binary.BigEndian.Uint16(b[:2]))
+
+	if _, err := readFull(stream, b[2:2+nr]); err != nil {
+		return 0, fmt.Errorf("read message from doq upstream %v error: %w", r.addr, err)
+	}
+	return nr, nil
+}
@@ -0,0 +1,56 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DoT is a DNS-over-TLS common.Resolver (RFC 7858). Queries are sent over a
+// TLS connection using the two-byte length prefix framing of DNS-over-TCP.
+type DoT struct {
+	addr    string
+	tlsConf *tls.Config
+	timeout time.Duration
+}
+
+// NewDoT creates a DoT resolver dialing addr (host:port) with tlsConf. A nil
+// tlsConf uses the server name parsed from addr for verification.
+func NewDoT(addr string, tlsConf *tls.Config, timeout time.Duration) *DoT {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &DoT{addr: addr, tlsConf: tlsConf, timeout: timeout}
+}
+
+// Resolve sends the query packed in b[2:2+n] to the upstream and writes the
+// response back into b[2:], returning the number of response bytes.
+func (r *DoT) Resolve(b []byte, n int) (int, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: r.timeout}, "tcp", r.addr, r.tlsConf)
+	if err != nil {
+		return 0, fmt.Errorf("dial dot upstream %v error: %w", r.addr, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	binary.BigEndian.PutUint16(b, uint16(n))
+	if _, err := conn.Write(b[:2+n]); err != nil {
+		return 0, fmt.Errorf("write to dot upstream %v error: %w", r.addr, err)
+	}
+
+	if _, err := readFull(conn, b[:2]); err != nil {
+		return 0, fmt.Errorf("read length from dot upstream %v error: %w", r.addr, err)
+	}
+	nr := int(binary.BigEndian.Uint16(b[:2]))
+
+	if _, err := readFull(conn, b[2:2+nr]); err != nil {
+		return 0, fmt.Errorf("read message from dot upstream %v error: %w", r.addr, err)
+	}
+	return nr, nil
+}
@@ -0,0 +1,140 @@
+package resolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/imgk/shadow/common"
+)
+
+// common.Resolver as seen from netstack.Stack:
+//
+//	type Resolver interface {
+//		Resolve(b []byte, n int) (int, error)
+//	}
+
+// Matcher decides whether a question name belongs to a named upstream group.
+// A Group evaluates its Matchers in the order they were added with AddRoute.
+type Matcher interface {
+	Match(name string) bool
+}
+
+// suffixMatcher matches a domain and all of its subdomains.
+type suffixMatcher string
+
+func (m suffixMatcher) Match(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	suffix := strings.TrimSuffix(string(m), ".")
+	return name == suffix || strings.HasSuffix(name, "."+suffix)
+}
+
+// keywordMatcher matches any question name containing the keyword.
+type keywordMatcher string
+
+func (m keywordMatcher) Match(name string) bool {
+	return strings.Contains(name, string(m))
+}
+
+// NewSuffixMatcher returns a Matcher for domain and all of its subdomains.
+func NewSuffixMatcher(domain string) Matcher {
+	return suffixMatcher(strings.ToLower(domain))
+}
+
+// NewKeywordMatcher returns a Matcher for question names containing keyword.
+func NewKeywordMatcher(keyword string) Matcher {
+	return keywordMatcher(strings.ToLower(keyword))
+}
+
+// treeMatcher adapts a *common.DomainTree lookup to the Matcher interface.
+type treeMatcher struct {
+	tree *common.DomainTree
+}
+
+// NewTreeMatcher returns a Matcher backed by an existing *common.DomainTree,
+// so rules already written for fake-IP/proxy domain lists can be reused to
+// route DNS queries as well.
+func NewTreeMatcher(tree *common.DomainTree) Matcher {
+	return treeMatcher{tree: tree}
+}
+
+func (m treeMatcher) Match(name string) bool {
+	return m.tree.Has(strings.TrimSuffix(name, "."))
+}
+
+// route pairs a Matcher with the named upstream it should route to.
+type route struct {
+	matcher Matcher
+	name    string
+}
+
+// Group is a common.Resolver that routes each query to a named upstream
+// common.Resolver based on the question name, falling back to a default
+// upstream when nothing matches.
+type Group struct {
+	upstreams map[string]common.Resolver
+	routes    []route
+	fallback  string
+}
+
+// NewGroup creates an empty Group. Upstreams are registered with Add and
+// routed to with AddRoute; SetFallback names the upstream used when no route
+// matches.
+func NewGroup() *Group {
+	return &Group{upstreams: make(map[string]common.Resolver)}
+}
+
+// Add registers an upstream common.Resolver under name.
+func (g *Group) Add(name string, r common.Resolver) *Group {
+	g.upstreams[name] = r
+	return g
+}
+
+// AddRoute routes question names matched by m to the upstream named name.
+// Routes are evaluated in the order they were added.
+func (g *Group) AddRoute(m Matcher, name string) *Group {
+	g.routes = append(g.routes, route{matcher: m, name: name})
+	return g
+}
+
+// SetFallback names the upstream used when no route matches a query.
+func (g *Group) SetFallback(name string) *Group {
+	g.fallback = name
+	return g
+}
+
+// Resolve unpacks the question from b[2:2+n], picks an upstream based on the
+// question name and delegates to it. It implements common.Resolver.
+func (g *Group) Resolve(b []byte, n int) (int, error) {
+	m := dns.Msg{}
+	if err := m.Unpack(b[2 : 2+n]); err != nil {
+		return 0, fmt.Errorf("unpack dns message error: %w", err)
+	}
+	if len(m.Question) == 0 {
+		return 0, fmt.Errorf("no question in dns message")
+	}
+	name := m.Question[0].Name
+
+	r, ok := g.pick(name)
+	if !ok {
+		return 0, fmt.Errorf("resolve %v error: %w", name, ErrNoUpstream)
+	}
+	return r.Resolve(b, n)
+}
+
+func (g *Group) pick(name string) (common.Resolver, bool) {
+	for _, rt := range g.routes {
+		if rt.matcher.Match(name) {
+			if r, ok := g.upstreams[rt.name]; ok {
+				return r, true
+			}
+		}
+	}
+	if g.fallback != "" {
+		if r, ok := g.upstreams[g.fallback]; ok {
+			return r, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,18 @@
+// Package resolver provides common.Resolver implementations for plain UDP,
+// DNS-over-TLS, DNS-over-HTTPS and DNS-over-QUIC upstreams, plus a Group
+// type that routes a query to a named upstream based on the question name.
+package resolver
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNoUpstream is returned when a Group has no matching upstream and no
+// fallback configured.
+var ErrNoUpstream = errors.New("no upstream resolver matched")
+
+// DefaultTimeout is used by upstream resolvers when no per-upstream timeout
+// is configured. It is independent of the 3s read deadline the stack uses
+// for reading queries off the hijacked UDP socket.
+const DefaultTimeout = time.Second * 5
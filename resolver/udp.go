@@ -0,0 +1,43 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// UDP is a plain DNS-over-UDP common.Resolver.
+type UDP struct {
+	addr    string
+	timeout time.Duration
+}
+
+// NewUDP creates a UDP resolver that sends queries to addr (host:port).
+func NewUDP(addr string, timeout time.Duration) *UDP {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &UDP{addr: addr, timeout: timeout}
+}
+
+// Resolve sends the query packed in b[2:2+n] to the upstream and writes the
+// response back into b[2:], returning the number of response bytes.
+func (r *UDP) Resolve(b []byte, n int) (int, error) {
+	conn, err := net.Dial("udp", r.addr)
+	if err != nil {
+		return 0, fmt.Errorf("dial udp upstream %v error: %w", r.addr, err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(r.timeout))
+
+	if _, err := conn.Write(b[2 : 2+n]); err != nil {
+		return 0, fmt.Errorf("write to udp upstream %v error: %w", r.addr, err)
+	}
+
+	nr, err := conn.Read(b[2:])
+	if err != nil {
+		return 0, fmt.Errorf("read from udp upstream %v error: %w", r.addr, err)
+	}
+	return nr, nil
+}
@@ -0,0 +1,8 @@
+package resolver
+
+import "io"
+
+// readFull reads exactly len(b) bytes from r.
+func readFull(r io.Reader, b []byte) (int, error) {
+	return io.ReadFull(r, b)
+}
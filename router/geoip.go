@@ -0,0 +1,62 @@
+package router
+
+import (
+	"fmt"
+
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/imgk/shadow/common"
+)
+
+// GeoIPRule matches a destination IP against one or more MaxMind GeoLite2
+// country codes loaded from an MMDB file.
+type GeoIPRule struct {
+	db      *maxminddb.Reader
+	codes   map[string]struct{}
+	action  Action
+	handler common.Handler
+}
+
+// NewGeoIPRule opens the MMDB file at path and builds a GeoIPRule that
+// matches when the destination IP's country is one of codes (ISO 3166-1
+// alpha-2, e.g. "CN", "US").
+func NewGeoIPRule(path string, codes []string, action Action, handler common.Handler) (*GeoIPRule, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip database %v error: %w", path, err)
+	}
+
+	set := make(map[string]struct{}, len(codes))
+	for _, c := range codes {
+		set[c] = struct{}{}
+	}
+
+	return &GeoIPRule{db: db, codes: set, action: action, handler: handler}, nil
+}
+
+// Close releases the underlying MMDB file.
+func (rule *GeoIPRule) Close() error {
+	return rule.db.Close()
+}
+
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+func (rule *GeoIPRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	if ctx.DstIP == nil || ctx.DstIP.IsPrivate() || ctx.DstIP.IsLoopback() {
+		return 0, nil, false
+	}
+
+	record := geoIPRecord{}
+	if err := rule.db.Lookup(ctx.DstIP, &record); err != nil {
+		return 0, nil, false
+	}
+
+	if _, ok := rule.codes[record.Country.ISOCode]; ok {
+		return rule.action, rule.handler, true
+	}
+	return 0, nil, false
+}
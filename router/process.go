@@ -0,0 +1,107 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// LookupProcess best-effort resolves the name of the process that owns the
+// local socket (srcIP, srcPort), so a ProcessNameRule can match on it. It
+// only works on Linux, by matching /proc/net/{tcp,udp} against the fd
+// symlinks under /proc/<pid>/fd/, and returns "" anywhere else or if the
+// owning process can't be found (e.g. it isn't running on this host, as is
+// the case for most connections proxied from elsewhere).
+func LookupProcess(network string, srcIP net.IP, srcPort uint16) string {
+	if runtime.GOOS != "linux" || srcIP.To4() == nil {
+		return ""
+	}
+
+	inode, ok := findInode(network, srcIP, srcPort)
+	if !ok {
+		return ""
+	}
+	return findProcessByInode(inode)
+}
+
+// findInode scans /proc/net/tcp or /proc/net/udp for the line whose local
+// address matches srcIP:srcPort, returning its socket inode.
+func findInode(network string, srcIP net.IP, srcPort uint16) (string, bool) {
+	path := "/proc/net/tcp"
+	if network == "udp" {
+		path = "/proc/net/udp"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	want := encodeLocalAddr(srcIP, srcPort)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header line
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		if fields[1] == want {
+			return fields[9], true
+		}
+	}
+	return "", false
+}
+
+// encodeLocalAddr formats ip:port the way /proc/net/tcp does: the address
+// as 8 uppercase hex digits in host byte order (little-endian on every
+// Linux target this runs on), the port as 4 uppercase hex digits in
+// network byte order.
+func encodeLocalAddr(ip net.IP, port uint16) string {
+	v4 := ip.To4()
+	addr := uint32(v4[3])<<24 | uint32(v4[2])<<16 | uint32(v4[1])<<8 | uint32(v4[0])
+	return fmt.Sprintf("%08X:%04X", addr, port)
+}
+
+// findProcessByInode walks /proc/<pid>/fd looking for a symlink to
+// socket:[inode], returning the owning process's name from /proc/<pid>/comm.
+func findProcessByInode(inode string) string {
+	target := "socket:[" + inode + "]"
+
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return ""
+	}
+	for _, p := range procs {
+		pid := p.Name()
+		if !p.IsDir() || pid[0] < '0' || pid[0] > '9' {
+			continue
+		}
+
+		fds, err := os.ReadDir(filepath.Join("/proc", pid, "fd"))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join("/proc", pid, "fd", fd.Name()))
+			if err != nil {
+				continue
+			}
+			if link != target {
+				continue
+			}
+
+			comm, err := os.ReadFile(filepath.Join("/proc", pid, "comm"))
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSpace(string(comm))
+		}
+	}
+	return ""
+}
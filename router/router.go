@@ -0,0 +1,177 @@
+// Package router implements a rule-based routing engine that decides, for
+// each connection or packet the netstack hands up, whether to let it
+// through directly, reject it, or proxy it through a named handler. It
+// replaces the inline private-IP/multicast checks that used to be baked
+// into netstack.Stack.
+package router
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/imgk/shadow/common"
+)
+
+// DefaultCacheTTL bounds how long a cached routing decision is reused
+// before Route re-evaluates the rules for it.
+const DefaultCacheTTL = time.Minute * 10
+
+// sweepInterval is how often the background sweep purges expired entries,
+// so the cache doesn't grow without bound from flows that are never
+// revisited and never explicitly Forgotten.
+const sweepInterval = time.Minute
+
+// Action is the outcome of matching a Rule.
+type Action int
+
+const (
+	// Direct lets the connection through without proxying.
+	Direct Action = iota
+	// Reject closes the connection immediately.
+	Reject
+	// Proxy hands the connection to the Rule's named handler.
+	Proxy
+)
+
+// RouteCtx carries everything a Rule needs to make a decision. Domain is
+// populated from the fake-IP reverse lookup when the connection's
+// destination is a fake IP, so domain-based rules still work on
+// UDP/TCP flows that only carry a fake IP.
+type RouteCtx struct {
+	Network string // "tcp" or "udp"
+	SrcIP   net.IP
+	SrcPort uint16 // local port of the owning process's socket
+	DstIP   net.IP
+	Port    uint16
+	Domain  string // original domain name, may be empty
+	Process string // owning process name, may be empty
+}
+
+// Rule decides an Action for a RouteCtx. ok is false when the rule does not
+// apply to ctx, in which case the Router moves on to the next rule.
+type Rule interface {
+	Match(ctx RouteCtx) (action Action, handler common.Handler, ok bool)
+}
+
+// tuple is the routing decision cache key. srcPort is included alongside
+// src so two different local processes racing a connection to the same
+// dst:port (a common case for a ProcessNameRule) don't collide on the same
+// cached decision.
+type tuple struct {
+	network string
+	src     string
+	srcPort uint16
+	dst     string
+	port    uint16
+}
+
+type decision struct {
+	action    Action
+	handler   common.Handler
+	expiresAt time.Time
+}
+
+// Router evaluates Rules in order and caches the decision per flow tuple so
+// repeated flows to the same destination skip rule evaluation. Entries
+// expire after DefaultCacheTTL and are swept in the background, so the
+// cache stays bounded even for flows that are never explicitly Forgotten.
+type Router struct {
+	rules []Rule
+	ttl   time.Duration
+
+	mu    sync.RWMutex
+	cache map[tuple]decision
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+// NewRouter builds a Router that evaluates rules in order. The last rule is
+// conventionally a MATCH rule that always matches, acting as the default.
+// Call Close to stop its background cache sweep.
+func NewRouter(rules []Rule) *Router {
+	r := &Router{
+		rules:   rules,
+		ttl:     DefaultCacheTTL,
+		cache:   make(map[tuple]decision),
+		closeCh: make(chan struct{}),
+	}
+	go r.sweepLoop()
+	return r
+}
+
+// Close stops the background cache sweep.
+func (r *Router) Close() error {
+	r.closeOnce.Do(func() { close(r.closeCh) })
+	return nil
+}
+
+func (r *Router) sweepLoop() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.sweep()
+		case <-r.closeCh:
+			return
+		}
+	}
+}
+
+func (r *Router) sweep() {
+	now := time.Now()
+	r.mu.Lock()
+	for key, d := range r.cache {
+		if now.After(d.expiresAt) {
+			delete(r.cache, key)
+		}
+	}
+	r.mu.Unlock()
+}
+
+func keyOf(ctx RouteCtx) tuple {
+	return tuple{network: ctx.Network, src: ctx.SrcIP.String(), srcPort: ctx.SrcPort, dst: ctx.DstIP.String(), port: ctx.Port}
+}
+
+// Route returns the Action and handler (if Proxy) for ctx, consulting and
+// populating the flow tuple cache.
+func (r *Router) Route(ctx RouteCtx) (Action, common.Handler) {
+	key := keyOf(ctx)
+
+	r.mu.RLock()
+	d, ok := r.cache[key]
+	r.mu.RUnlock()
+	if ok && time.Now().Before(d.expiresAt) {
+		return d.action, d.handler
+	}
+
+	action, handler := r.match(ctx)
+
+	r.mu.Lock()
+	r.cache[key] = decision{action: action, handler: handler, expiresAt: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+
+	return action, handler
+}
+
+// Forget evicts a cached decision, e.g. once a flow has closed, so a later
+// flow to the same destination re-evaluates the rules instead of reusing a
+// decision made for a connection that no longer exists.
+func (r *Router) Forget(ctx RouteCtx) {
+	key := keyOf(ctx)
+	r.mu.Lock()
+	delete(r.cache, key)
+	r.mu.Unlock()
+}
+
+func (r *Router) match(ctx RouteCtx) (Action, common.Handler) {
+	for _, rule := range r.rules {
+		if action, handler, ok := rule.Match(ctx); ok {
+			return action, handler
+		}
+	}
+	// no MATCH rule configured: behave like the stack used to and proxy.
+	return Proxy, nil
+}
@@ -0,0 +1,189 @@
+package router
+
+import (
+	"net"
+	"strings"
+
+	"github.com/imgk/shadow/common"
+)
+
+// IPCIDRRule matches a destination IP against one or more CIDR blocks. It
+// handles both IPCIDR and IPCIDR6 entries: net.IPNet already distinguishes
+// the two by the length of its IP field.
+type IPCIDRRule struct {
+	nets    []*net.IPNet
+	action  Action
+	handler common.Handler
+}
+
+// NewIPCIDRRule builds an IPCIDRRule from CIDR strings such as
+// "10.0.0.0/8" or "fe80::/10".
+func NewIPCIDRRule(cidrs []string, action Action, handler common.Handler) (*IPCIDRRule, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return &IPCIDRRule{nets: nets, action: action, handler: handler}, nil
+}
+
+func (rule *IPCIDRRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	for _, ipnet := range rule.nets {
+		if ipnet.Contains(ctx.DstIP) {
+			return rule.action, rule.handler, true
+		}
+	}
+	return 0, nil, false
+}
+
+// DomainRule matches an exact question/SNI domain.
+type DomainRule struct {
+	domains map[string]struct{}
+	action  Action
+	handler common.Handler
+}
+
+// NewDomainRule builds a DomainRule from a list of exact domain names.
+func NewDomainRule(domains []string, action Action, handler common.Handler) *DomainRule {
+	set := make(map[string]struct{}, len(domains))
+	for _, d := range domains {
+		set[strings.ToLower(strings.TrimSuffix(d, "."))] = struct{}{}
+	}
+	return &DomainRule{domains: set, action: action, handler: handler}
+}
+
+func (rule *DomainRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	if ctx.Domain == "" {
+		return 0, nil, false
+	}
+	if _, ok := rule.domains[strings.ToLower(strings.TrimSuffix(ctx.Domain, "."))]; ok {
+		return rule.action, rule.handler, true
+	}
+	return 0, nil, false
+}
+
+// DomainSuffixRule matches a domain and all of its subdomains.
+type DomainSuffixRule struct {
+	suffixes []string
+	action   Action
+	handler  common.Handler
+}
+
+// NewDomainSuffixRule builds a DomainSuffixRule from a list of suffixes.
+func NewDomainSuffixRule(suffixes []string, action Action, handler common.Handler) *DomainSuffixRule {
+	list := make([]string, 0, len(suffixes))
+	for _, s := range suffixes {
+		list = append(list, strings.ToLower(strings.TrimSuffix(s, ".")))
+	}
+	return &DomainSuffixRule{suffixes: list, action: action, handler: handler}
+}
+
+func (rule *DomainSuffixRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	if ctx.Domain == "" {
+		return 0, nil, false
+	}
+	domain := strings.ToLower(strings.TrimSuffix(ctx.Domain, "."))
+	for _, suffix := range rule.suffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return rule.action, rule.handler, true
+		}
+	}
+	return 0, nil, false
+}
+
+// DomainKeywordRule matches any domain containing one of a set of keywords.
+type DomainKeywordRule struct {
+	keywords []string
+	action   Action
+	handler  common.Handler
+}
+
+// NewDomainKeywordRule builds a DomainKeywordRule from a list of keywords.
+func NewDomainKeywordRule(keywords []string, action Action, handler common.Handler) *DomainKeywordRule {
+	list := make([]string, len(keywords))
+	for i, k := range keywords {
+		list[i] = strings.ToLower(k)
+	}
+	return &DomainKeywordRule{keywords: list, action: action, handler: handler}
+}
+
+func (rule *DomainKeywordRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	if ctx.Domain == "" {
+		return 0, nil, false
+	}
+	domain := strings.ToLower(ctx.Domain)
+	for _, keyword := range rule.keywords {
+		if strings.Contains(domain, keyword) {
+			return rule.action, rule.handler, true
+		}
+	}
+	return 0, nil, false
+}
+
+// PortRule matches a destination port.
+type PortRule struct {
+	ports   map[uint16]struct{}
+	action  Action
+	handler common.Handler
+}
+
+// NewPortRule builds a PortRule from a list of ports.
+func NewPortRule(ports []uint16, action Action, handler common.Handler) *PortRule {
+	set := make(map[uint16]struct{}, len(ports))
+	for _, p := range ports {
+		set[p] = struct{}{}
+	}
+	return &PortRule{ports: set, action: action, handler: handler}
+}
+
+func (rule *PortRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	if _, ok := rule.ports[ctx.Port]; ok {
+		return rule.action, rule.handler, true
+	}
+	return 0, nil, false
+}
+
+// ProcessNameRule matches the name of the process that owns the connection.
+type ProcessNameRule struct {
+	names   map[string]struct{}
+	action  Action
+	handler common.Handler
+}
+
+// NewProcessNameRule builds a ProcessNameRule from a list of process names.
+func NewProcessNameRule(names []string, action Action, handler common.Handler) *ProcessNameRule {
+	set := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		set[n] = struct{}{}
+	}
+	return &ProcessNameRule{names: set, action: action, handler: handler}
+}
+
+func (rule *ProcessNameRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	if ctx.Process == "" {
+		return 0, nil, false
+	}
+	if _, ok := rule.names[ctx.Process]; ok {
+		return rule.action, rule.handler, true
+	}
+	return 0, nil, false
+}
+
+// FinalRule always matches; it is the MATCH rule conventionally placed last
+// in a rule set to provide a default action.
+type FinalRule struct {
+	action  Action
+	handler common.Handler
+}
+
+// NewFinalRule builds the default MATCH rule.
+func NewFinalRule(action Action, handler common.Handler) *FinalRule {
+	return &FinalRule{action: action, handler: handler}
+}
+
+func (rule *FinalRule) Match(ctx RouteCtx) (Action, common.Handler, bool) {
+	return rule.action, rule.handler, true
+}
@@ -0,0 +1,104 @@
+package router
+
+import (
+	"net"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("parse cidr %q: %v", s, err)
+	}
+	return n
+}
+
+func TestIPCIDRRuleMatch(t *testing.T) {
+	rule := &IPCIDRRule{nets: []*net.IPNet{mustCIDR(t, "10.0.0.0/8")}, action: Direct}
+
+	if _, _, ok := rule.Match(RouteCtx{DstIP: net.ParseIP("10.1.2.3")}); !ok {
+		t.Fatal("expected match for address inside the CIDR")
+	}
+	if _, _, ok := rule.Match(RouteCtx{DstIP: net.ParseIP("8.8.8.8")}); ok {
+		t.Fatal("expected no match for address outside the CIDR")
+	}
+}
+
+func TestDomainRuleMatch(t *testing.T) {
+	rule := NewDomainRule([]string{"Example.com."}, Reject, nil)
+
+	if _, _, ok := rule.Match(RouteCtx{Domain: ""}); ok {
+		t.Fatal("expected no match for empty domain")
+	}
+	if _, _, ok := rule.Match(RouteCtx{Domain: "other.com"}); ok {
+		t.Fatal("expected no match for unrelated domain")
+	}
+	if _, _, ok := rule.Match(RouteCtx{Domain: "example.com"}); !ok {
+		t.Fatal("expected a case/trailing-dot-insensitive match")
+	}
+}
+
+func TestDomainSuffixRuleMatch(t *testing.T) {
+	rule := NewDomainSuffixRule([]string{"example.com"}, Proxy, nil)
+
+	cases := []struct {
+		domain string
+		want   bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"notexample.com", false},
+		{"example.org", false},
+	}
+	for _, c := range cases {
+		if _, _, ok := rule.Match(RouteCtx{Domain: c.domain}); ok != c.want {
+			t.Errorf("domain %q: got match=%v, want %v", c.domain, ok, c.want)
+		}
+	}
+}
+
+func TestDomainKeywordRuleMatch(t *testing.T) {
+	rule := NewDomainKeywordRule([]string{"ads"}, Reject, nil)
+
+	if _, _, ok := rule.Match(RouteCtx{Domain: "ads.example.com"}); !ok {
+		t.Fatal("expected match on keyword substring")
+	}
+	if _, _, ok := rule.Match(RouteCtx{Domain: "example.com"}); ok {
+		t.Fatal("expected no match without the keyword")
+	}
+}
+
+func TestPortRuleMatch(t *testing.T) {
+	rule := NewPortRule([]uint16{80, 443}, Direct, nil)
+
+	if _, _, ok := rule.Match(RouteCtx{Port: 443}); !ok {
+		t.Fatal("expected match on listed port")
+	}
+	if _, _, ok := rule.Match(RouteCtx{Port: 22}); ok {
+		t.Fatal("expected no match on unlisted port")
+	}
+}
+
+func TestProcessNameRuleMatch(t *testing.T) {
+	rule := NewProcessNameRule([]string{"curl"}, Proxy, nil)
+
+	if _, _, ok := rule.Match(RouteCtx{Process: ""}); ok {
+		t.Fatal("expected no match when Process hasn't been populated")
+	}
+	if _, _, ok := rule.Match(RouteCtx{Process: "wget"}); ok {
+		t.Fatal("expected no match for an unlisted process")
+	}
+	action, _, ok := rule.Match(RouteCtx{Process: "curl"})
+	if !ok || action != Proxy {
+		t.Fatalf("expected Proxy match for a listed process, got action=%v ok=%v", action, ok)
+	}
+}
+
+func TestFinalRuleAlwaysMatches(t *testing.T) {
+	rule := NewFinalRule(Reject, nil)
+	action, _, ok := rule.Match(RouteCtx{})
+	if !ok || action != Reject {
+		t.Fatalf("expected FinalRule to always match with its configured action, got action=%v ok=%v", action, ok)
+	}
+}